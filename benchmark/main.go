@@ -115,8 +115,9 @@ func benchmarkSyncMapStructs() {
 // Benchmark for go-persist using synchronous Set (structs)
 func benchmarkPersistStructsSync() {
 	os.Remove("persist_sync.db1")
-	// Create a persistent map for TestStruct
-	persistStructMap, err := persist.OpenSingleMap[TestStruct]("persist_sync.db1")
+	// Create a persistent map for TestStruct, presized for the pre-population
+	persistStructMap, err := persist.OpenSingleMapWithOptions[TestStruct]("persist_sync.db1",
+		persist.WithSingleMapOptions(persist.WithInitialCapacity(prePopCount)))
 	if err != nil {
 		panic(err)
 	}
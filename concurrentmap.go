@@ -0,0 +1,41 @@
+package persist
+
+import "github.com/puzpuzpuz/xsync/v3"
+
+// ConcurrentMap is a concurrent map with string keys, holding the in-memory values
+// and dirty keys of a PersistMap and the orphan records of a Store. *xsync.Map, used
+// by default, implements it; another implementation, e.g. a sharded map with a custom
+// hash for adversarial or highly similar keys, can be set with WithMapFactory.
+//
+// All methods must be safe for concurrent use. Compute must be atomic for the key,
+// while valueFn may access other keys of the same map. Range must tolerate changes
+// of the map during iteration, including by f itself, and visit each key present
+// for the whole iteration exactly once. It must not hold locks while f runs (e.g.
+// copy entries of a shard before calling f for them), as PersistMap.Range promises
+// that a slow f doesn't block writers.
+type ConcurrentMap interface {
+	// Load returns the value stored for the key
+	Load(key string) (value interface{}, ok bool)
+	// Store sets the value for the key
+	Store(key string, value interface{})
+	// Delete removes the key
+	Delete(key string)
+	// Compute atomically replaces the value of the key with the one returned by
+	// valueFn, or deletes the key if delete is true. Returns the resulting value
+	// and whether the key is present.
+	Compute(key string, valueFn func(oldValue interface{}, loaded bool) (newValue interface{}, delete bool)) (actual interface{}, ok bool)
+	// Range calls f for each key and value until f returns false
+	Range(f func(key string, value interface{}) bool)
+	// Size returns the number of keys
+	Size() int
+	// Clear removes all keys
+	Clear()
+}
+
+// newXsyncMap is the default map factory, see WithMapFactory
+func newXsyncMap(sizeHint int) ConcurrentMap {
+	if sizeHint > 0 {
+		return xsync.NewMap(xsync.WithPresize(sizeHint))
+	}
+	return xsync.NewMap()
+}
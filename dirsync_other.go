@@ -0,0 +1,8 @@
+//go:build !unix
+
+package persist
+
+// fsyncDir is a no-op on platforms where directories can't be fsynced, e.g. Windows
+func fsyncDir(path string) error {
+	return nil
+}
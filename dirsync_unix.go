@@ -0,0 +1,23 @@
+//go:build unix
+
+package persist
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fsyncDir fsyncs the directory at path, making entries created or renamed in it
+// durable. Filesystems that don't support syncing directories are ignored.
+func fsyncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build linux
+
+package persist
+
+import "syscall"
+
+// syncWriteFlag makes every write to the WAL durable, see WithSyncOnWrite. O_DSYNC
+// skips flushing metadata like the modification time, unlike O_SYNC.
+const syncWriteFlag = syscall.O_DSYNC
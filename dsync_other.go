@@ -0,0 +1,8 @@
+//go:build !linux
+
+package persist
+
+import "os"
+
+// syncWriteFlag makes every write to the WAL durable, see WithSyncOnWrite
+const syncWriteFlag = os.O_SYNC
@@ -0,0 +1,83 @@
+package persist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/goccy/go-json"
+)
+
+// Encoder can be implemented by value types to store them in the WAL with a custom
+// encoding instead of JSON, e.g. to hand-optimize a hot fixed-layout struct.
+// The encoded value must not contain newlines, as they delimit WAL records.
+//
+// Encoder and Decoder take precedence over the store's JSON encoding, including
+// json.Marshaler and json.Unmarshaler implemented by the same type. Values with a
+// custom encoding are not JSON, so DumpJSON embeds them as JSON strings, and they
+// can't be imported by LoadJSON.
+type Encoder interface {
+	EncodePersist() ([]byte, error)
+}
+
+// Decoder is implemented by pointers to value types that implement Encoder,
+// decoding the value from the data produced by EncodePersist.
+type Decoder interface {
+	DecodePersist(data []byte) error
+}
+
+var errNewlineInValue = errors.New("encoded value contains a newline")
+
+// JSONOptions configures the JSON encoding of values in the WAL, see WithJSONOptions.
+// The zero value keeps the defaults of goccy/go-json, which match encoding/json.
+// Floats are always written in the shortest form that decodes to the same value.
+type JSONOptions struct {
+	// DisableHTMLEscape writes <, > and & in strings as is, instead of \u003c etc.
+	DisableHTMLEscape bool
+	// UseNumber decodes numbers into interface{} values (e.g. map[string]any) as
+	// json.Number instead of float64, preserving integers beyond 2^53
+	UseNumber bool
+}
+
+// encodeValue serializes a value for the WAL using its Encoder, or JSON otherwise
+func (s *Store) encodeValue(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case lazyValue:
+		return []byte(v), nil
+	case Encoder:
+		data, err := v.EncodePersist()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.IndexByte(data, '\n') >= 0 {
+			return nil, errNewlineInValue
+		}
+		return data, nil
+	}
+	if s.jsonOptions.DisableHTMLEscape {
+		return json.MarshalWithOption(value, json.DisableHTMLEscape())
+	}
+	return json.Marshal(value)
+}
+
+// decodeValue deserializes data from the WAL into v (a pointer) using its Decoder,
+// or JSON otherwise
+func (s *Store) decodeValue(data []byte, v interface{}) error {
+	if d, ok := v.(Decoder); ok {
+		return d.DecodePersist(data)
+	}
+	if s.jsonOptions.UseNumber {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+		// Decode stops after the first value, reject anything but spaces after it
+		// like json.Unmarshal does
+		if rest := bytes.TrimSpace(data[dec.InputOffset():]); len(rest) > 0 {
+			return fmt.Errorf("invalid character %q after top-level value", rest[0])
+		}
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
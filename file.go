@@ -0,0 +1,556 @@
+package persist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WALFile is the storage the WAL is kept in. Store.Open uses a file on disk,
+// Store.OpenFile accepts any implementation, e.g. MemFile.
+//
+// The Store serializes calls to Write, Sync, Size and Commit of a rewrite,
+// while readers may be used concurrently with them.
+type WALFile interface {
+	// Write appends p to the end of the WAL
+	Write(p []byte) (int, error)
+	// Sync commits appended data to stable storage
+	Sync() error
+	// Size returns the current size of the WAL in bytes
+	Size() (int64, error)
+	// NewReader returns a reader of the WAL contents from the beginning
+	NewReader() (io.ReadCloser, error)
+	// Rewrite starts replacing the WAL contents, used by Shrink
+	Rewrite() (WALRewriter, error)
+	// Truncate cuts the WAL to size bytes, used to drop a torn record on load
+	Truncate(size int64) error
+	Close() error
+}
+
+// WALRewriter receives new contents of a WALFile. The old contents stay in
+// place until Commit, so a failed rewrite doesn't lose any data.
+type WALRewriter interface {
+	io.Writer
+	Sync() error
+	// Commit atomically replaces the WAL contents with the written data.
+	// Further writes to the WALFile append to the new contents. If Commit
+	// fails, the WALFile should remain usable with the old contents. If only
+	// making the replacement durable failed, the new contents are used and the
+	// error must wrap ErrCommitNotDurable.
+	Commit() error
+	// Abort discards the written data
+	Abort() error
+}
+
+// syncDir makes entries created or renamed in a directory durable, a variable to
+// let tests simulate failures
+var syncDir = fsyncDir
+
+// osFile is the WALFile stored on disk. Rewrites go to a temporary file
+// which is renamed over the WAL on commit.
+//
+// In network mode (see WithNetworkFilesystem) the file is locked and written at
+// an explicitly tracked offset instead of relying on O_APPEND.
+type osFile struct {
+	f       *os.File
+	path    string
+	flags   int
+	mode    os.FileMode
+	network bool
+	offset  int64 // end of the WAL in network mode
+}
+
+// openOSFile opens (or creates) the WAL file at path for appending. A created
+// file is made durable by syncing its directory.
+func openOSFile(path string, flags int, mode os.FileMode, network bool) (*osFile, error) {
+	o := &osFile{path: path, flags: flags, mode: mode, network: network}
+	_, statErr := os.Stat(path)
+	if err := o.open(path); err != nil {
+		return nil, err
+	}
+	if errors.Is(statErr, fs.ErrNotExist) {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			o.f.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// open opens the file at path as the WAL, locking it in network mode
+func (o *osFile) open(path string) error {
+	f, err := os.OpenFile(path, o.flags, o.mode)
+	if err != nil {
+		return err
+	}
+	if o.network {
+		if err := o.adopt(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	o.f = f
+	return nil
+}
+
+// adopt locks f and starts writing at its end, for network mode
+func (o *osFile) adopt(f *os.File) error {
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	o.offset = info.Size()
+	return nil
+}
+
+func (o *osFile) Write(p []byte) (int, error) {
+	if o.network {
+		n, err := o.f.WriteAt(p, o.offset)
+		o.offset += int64(n)
+		return n, err
+	}
+	return o.f.Write(p)
+}
+
+func (o *osFile) Sync() error {
+	return o.f.Sync()
+}
+
+func (o *osFile) Size() (int64, error) {
+	if o.network {
+		// Attributes may be cached by the client, the offset is exact
+		return o.offset, nil
+	}
+	stat, err := o.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (o *osFile) NewReader() (io.ReadCloser, error) {
+	if o.network {
+		// Closing another descriptor of the file would release the lock
+		return io.NopCloser(io.NewSectionReader(o.f, 0, o.offset)), nil
+	}
+	return os.Open(o.path)
+}
+
+func (o *osFile) Truncate(size int64) error {
+	if err := o.f.Truncate(size); err != nil {
+		return err
+	}
+	o.offset = size
+	return o.f.Sync()
+}
+
+// check verifies that the WAL is accessible and is still the file at its path
+func (o *osFile) check() error {
+	info, err := o.f.Stat()
+	if err != nil {
+		return err
+	}
+	pathInfo, err := os.Stat(o.path)
+	if err != nil {
+		return fmt.Errorf("WAL file is not accessible by its path: %w", err)
+	}
+	if !os.SameFile(info, pathInfo) {
+		return fmt.Errorf("WAL file %s was replaced", o.path)
+	}
+	return nil
+}
+
+// reopen opens the file at the path again if it was replaced, e.g. renamed over by
+// another process
+func (o *osFile) reopen() error {
+	if o.check() == nil {
+		return nil
+	}
+	f, err := os.OpenFile(o.path, o.flags&^os.O_CREATE, o.mode)
+	if err != nil {
+		return err
+	}
+	o.f.Close()
+	o.f = f
+	return nil
+}
+
+func (o *osFile) Close() error {
+	return o.f.Close()
+}
+
+func (o *osFile) Rewrite() (WALRewriter, error) {
+	tmpPath := o.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, o.mode)
+	if err != nil {
+		return nil, err
+	}
+	rw := &osRewriter{File: tmpFile, parent: o}
+	if o.network {
+		// Lock the new WAL before it replaces the old one, it stays open after Commit
+		if err := lockFile(tmpFile); err != nil {
+			rw.Abort()
+			return nil, err
+		}
+	}
+
+	// Preserve mode and ownership of the original file, as the rename replaces them
+	if err := copyFileAttrs(tmpFile, o.path); err != nil {
+		rw.Abort()
+		return nil, err
+	}
+	return rw, nil
+}
+
+// copyFileAttrs sets permissions and owner of f to match the file at path
+func copyFileAttrs(f *os.File, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	return copyOwner(f, info)
+}
+
+// osRewriter writes new contents of an osFile to a temporary file
+type osRewriter struct {
+	*os.File
+	parent *osFile
+}
+
+func (w *osRewriter) Commit() error {
+	if w.parent.network {
+		return w.commitLocked()
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+
+	// Close current file, atomically rename the temporary file, and reopen the WAL.
+	// The file is closed first, as renaming over an open file fails on Windows
+	if err := w.parent.f.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	renameErr := os.Rename(w.Name(), w.parent.path)
+	if renameErr != nil {
+		os.Remove(w.Name())
+	}
+	// Reopen the WAL (the old one if rename failed), so the store stays writable
+	f, err := os.OpenFile(w.parent.path, w.parent.flags, w.parent.mode)
+	if err != nil {
+		return err
+	}
+	w.parent.f = f
+	if renameErr != nil {
+		return renameErr
+	}
+	// Without it, the rename may be lost on a crash
+	return commitDurable(w.parent.path)
+}
+
+// commitLocked renames the locked temporary file over the WAL and keeps using
+// it, so the WAL is never unlocked, see WithNetworkFilesystem
+func (w *osRewriter) commitLocked() error {
+	size, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if err := os.Rename(w.Name(), w.parent.path); err != nil {
+		w.Abort()
+		return err
+	}
+	w.parent.f.Close()
+	w.parent.f = w.File
+	w.parent.offset = size
+	return commitDurable(w.parent.path)
+}
+
+func (w *osRewriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// pathRewriter writes a WAL to a temporary file which is renamed to path on commit,
+// used by Store.CompactTo
+type pathRewriter struct {
+	*os.File
+	path string
+}
+
+func newPathRewriter(path string, mode os.FileMode) (*pathRewriter, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &pathRewriter{File: tmpFile, path: path}
+	if err := tmpFile.Chmod(mode); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *pathRewriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := os.Rename(w.Name(), w.path); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return commitDurable(w.path)
+}
+
+// commitDurable syncs the directory of path after a file was renamed to it. A
+// failure is wrapped in ErrCommitNotDurable, as the rename itself succeeded.
+func commitDurable(path string) error {
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("%w: %w", ErrCommitNotDurable, err)
+	}
+	return nil
+}
+
+func (w *pathRewriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// errSectionRewritten is returned by readers of a sectionFile whose contents were
+// replaced by a rewrite while reading
+var errSectionRewritten = errors.New("embedded WAL was rewritten while reading")
+
+// sectionFile is the WALFile embedded in a larger file from a base offset to the
+// end of the file, see Store.OpenAt. Rewrites go to a temporary file and are copied
+// over the section on commit, which, unlike a rename, is not atomic.
+type sectionFile struct {
+	mu   sync.RWMutex // held for writing while a commit replaces the contents
+	f    *os.File
+	base int64  // offset of the WAL in f
+	size int64  // size of the WAL, i.e. bytes from base to the end of f
+	gen  uint64 // number of commits, readers fail once it changes
+}
+
+// newSectionFile returns the WALFile stored in f from offset base
+func newSectionFile(f *os.File, base int64) (*sectionFile, error) {
+	if base < 0 {
+		return nil, errors.New("negative WAL offset")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < base {
+		return nil, fmt.Errorf("file is shorter than the WAL offset %d", base)
+	}
+	return &sectionFile{f: f, base: base, size: info.Size() - base}, nil
+}
+
+func (sf *sectionFile) Write(p []byte) (int, error) {
+	n, err := sf.f.WriteAt(p, sf.base+sf.size)
+	sf.size += int64(n)
+	return n, err
+}
+
+func (sf *sectionFile) Sync() error {
+	return sf.f.Sync()
+}
+
+func (sf *sectionFile) Size() (int64, error) {
+	return sf.size, nil
+}
+
+func (sf *sectionFile) NewReader() (io.ReadCloser, error) {
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+	return &sectionReader{
+		r:      io.NewSectionReader(sf.f, sf.base, sf.size),
+		parent: sf,
+		gen:    sf.gen,
+	}, nil
+}
+
+func (sf *sectionFile) Truncate(size int64) error {
+	if err := sf.f.Truncate(sf.base + size); err != nil {
+		return err
+	}
+	sf.size = size
+	return sf.f.Sync()
+}
+
+func (sf *sectionFile) Rewrite() (WALRewriter, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(sf.f.Name()), filepath.Base(sf.f.Name())+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &sectionRewriter{File: tmpFile, parent: sf}, nil
+}
+
+func (sf *sectionFile) Close() error {
+	return sf.f.Close()
+}
+
+// sectionReader reads the contents of a sectionFile, failing with errSectionRewritten
+// if a commit replaced them since the reader was created
+type sectionReader struct {
+	r      *io.SectionReader
+	parent *sectionFile
+	gen    uint64
+}
+
+func (r *sectionReader) Read(p []byte) (int, error) {
+	r.parent.mu.RLock()
+	defer r.parent.mu.RUnlock()
+	if r.parent.gen != r.gen {
+		return 0, errSectionRewritten
+	}
+	return r.r.Read(p)
+}
+
+func (r *sectionReader) Close() error {
+	return nil
+}
+
+// sectionRewriter writes new contents of a sectionFile to a temporary file
+type sectionRewriter struct {
+	*os.File
+	parent *sectionFile
+}
+
+// Commit copies the new contents over the section. If the copy fails, the section
+// may be damaged, so the temporary file is kept to recover the data from.
+func (w *sectionRewriter) Commit() error {
+	size, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		w.Abort()
+		return err
+	}
+
+	sf := w.parent
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.gen++
+	_, err = io.Copy(io.NewOffsetWriter(sf.f, sf.base), w.File)
+	if err == nil {
+		err = sf.f.Truncate(sf.base + size)
+	}
+	if err == nil {
+		err = sf.f.Sync()
+	}
+	if err != nil {
+		w.File.Close()
+		return fmt.Errorf("failed to copy the rewritten WAL, its contents are kept in %s: %w", w.Name(), err)
+	}
+	sf.size = size
+	return w.Abort()
+}
+
+func (w *sectionRewriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// MemFile is a WALFile kept in memory. Useful for tests and ephemeral stores,
+// or for loading a WAL received over the network:
+//
+//	store := persist.New()
+//	users, _ := persist.Map[User](store, "users")
+//	err := store.OpenFile(persist.NewMemFile(walBytes))
+//
+// Store options related to files on disk (WithFileMode, WithSyncOnWrite) have no effect.
+type MemFile struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewMemFile returns a MemFile with the given initial contents, which may be nil
+// to start an empty WAL. The MemFile takes ownership of data.
+func NewMemFile(data []byte) *MemFile {
+	return &MemFile{buf: data}
+}
+
+// Bytes returns a copy of the current WAL contents. Remains usable after the Store is closed.
+func (m *MemFile) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return bytes.Clone(m.buf)
+}
+
+func (m *MemFile) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buf = append(m.buf, p...)
+	return len(p), nil
+}
+
+func (m *MemFile) Sync() error {
+	return nil
+}
+
+func (m *MemFile) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.buf)), nil
+}
+
+func (m *MemFile) NewReader() (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Written bytes are never modified in place, so the reader can share them
+	return io.NopCloser(bytes.NewReader(m.buf[:len(m.buf):len(m.buf)])), nil
+}
+
+func (m *MemFile) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Limit the capacity, so the next Write doesn't modify bytes shared with readers
+	m.buf = m.buf[:size:size]
+	return nil
+}
+
+func (m *MemFile) Rewrite() (WALRewriter, error) {
+	return &memRewriter{parent: m}, nil
+}
+
+func (m *MemFile) Close() error {
+	return nil
+}
+
+// memRewriter collects new contents of a MemFile
+type memRewriter struct {
+	bytes.Buffer
+	parent *MemFile
+}
+
+func (w *memRewriter) Sync() error {
+	return nil
+}
+
+func (w *memRewriter) Commit() error {
+	w.parent.mu.Lock()
+	defer w.parent.mu.Unlock()
+	w.parent.buf = w.Bytes()
+	return nil
+}
+
+func (w *memRewriter) Abort() error {
+	w.Reset()
+	return nil
+}
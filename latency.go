@@ -0,0 +1,64 @@
+package persist
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// recentLatencyWeight is the weight of the previous average in LatencyStats.Recent,
+// e.g. with 16 it mostly reflects the last few dozen operations
+const recentLatencyWeight = 16
+
+// LatencyStats summarizes durations of a kind of WAL operation since Open,
+// see Store.Latency
+type LatencyStats struct {
+	Count  int64         // number of operations
+	Mean   time.Duration // average of all operations
+	Recent time.Duration // moving average weighted to the latest operations, rises first when the disk slows down
+	Max    time.Duration // slowest operation
+}
+
+// latencyTracker accumulates LatencyStats. Operations are recorded under Store.mu,
+// while the stats are read without locks.
+type latencyTracker struct {
+	count  atomic.Int64
+	total  atomic.Int64
+	recent atomic.Int64
+	max    atomic.Int64
+}
+
+// record adds an operation that started at start, callers must be serialized
+func (t *latencyTracker) record(start time.Time) {
+	d := int64(time.Since(start))
+	if t.count.Add(1) == 1 {
+		t.recent.Store(d)
+	} else {
+		recent := t.recent.Load()
+		t.recent.Store(recent + (d-recent)/recentLatencyWeight)
+	}
+	t.total.Add(d)
+	if d > t.max.Load() {
+		t.max.Store(d)
+	}
+}
+
+// stats returns the accumulated stats
+func (t *latencyTracker) stats() LatencyStats {
+	st := LatencyStats{
+		Count:  t.count.Load(),
+		Recent: time.Duration(t.recent.Load()),
+		Max:    time.Duration(t.max.Load()),
+	}
+	if st.Count > 0 {
+		st.Mean = time.Duration(t.total.Load() / st.Count)
+	}
+	return st
+}
+
+// Latency returns durations of WAL writes and fsyncs since Open, e.g. to detect
+// a slowing disk in production. Writes include those of immediate methods and of
+// the background sync, fsyncs include those of FSyncAll and of FSync methods.
+// Writes and fsyncs of Shrink are not included.
+func (s *Store) Latency() (write, sync LatencyStats) {
+	return s.writeLatency.stats(), s.syncLatency.stats()
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package persist
+
+import "os"
+
+// lockFile is a no-op on platforms without fcntl locks
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package persist
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive lock of the whole file f, failing with ErrLocked if
+// another process holds it. fcntl locks are used, as unlike flock they're supported
+// by NFS. They are released once any descriptor of the file is closed by the process.
+func lockFile(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return ErrLocked
+	}
+	return err
+}
@@ -4,42 +4,213 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"iter"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/goccy/go-json"
 	"github.com/puzpuzpuz/xsync/v3"
 )
 
+// AnyMap is implemented by every PersistMap regardless of its value type, so tools
+// like admin utilities can operate on all maps of a store, see Store.Maps.
+// The typed methods of PersistMap remain the primary API.
+type AnyMap interface {
+	// Name returns the name the map was registered with
+	Name() string
+	// Size returns the number of keys in the map
+	Size() int
+	// PendingCount returns the number of changes awaiting the background sync
+	PendingCount() int
+	// RangeRaw calls f for each key with its value encoded as in the WAL, usually JSON
+	RangeRaw(f func(key, rawValue string) bool) error
+}
+
 // persistMapI defines the common interface during bulk loading and Shrink()
 type persistMapI interface {
+	AnyMap
 	processRecord(op, fullKey, valueLine string) error
 	writeRecords(w io.Writer) (int32, error)
+	rangeJSON(f func(fullKey string, data []byte) bool) error
+	setJSON(key, value string) error
+	mergeJSON(key string, incoming []byte, resolver func(key string, existing, incoming []byte) []byte) error
+	presize(sizeHint int)
+	valueType() reflect.Type
+	reset()
 }
 
 type PersistMap[T any] struct {
-	Store  *Store     // underlying WAL store
-	data   *xsync.Map // in-memory map holding decoded values of type T
-	prefix string     // namespace prefix for keys (e.g. "mapName:")
-	dirty  *xsync.Map // set of dirty keys; value is struct{} as a dummy
+	Store      *Store                        // underlying WAL store
+	data       atomic.Pointer[ConcurrentMap] // in-memory map holding decoded values of type T (or lazyValue)
+	replaceMu  sync.RWMutex                  // held for reading by writes, for writing by ReplaceAll and batch deletes
+	prefix     string                        // namespace prefix for keys (e.g. "mapName:")
+	dirty      ConcurrentMap                 // set of dirty keys; value is struct{} as a dummy
+	lazy       bool                          // keep loaded values as raw JSON until first access
+	maxPending int                           // Sync immediately once this many keys are dirty (0 - unlimited)
+	times      *xsync.Map                    // last modification time of keys in unix nanoseconds, nil if disabled
+	capacity   int                           // minimum presize of data, see WithInitialCapacity
+	coalesce   int64                         // min nanoseconds between immediate writes of a key, see WithWriteCoalescing
+	lastWrites *xsync.Map                    // time of the last immediate write of keys in unix nanoseconds, nil if disabled
+
+	readThrough        func(key string) (T, bool) // source of keys missing on Get, nil if disabled
+	readThroughPersist bool                       // write fetched values to the WAL
+}
+
+// Meta holds metadata of a value, see GetWithMeta
+type Meta struct {
+	Modified time.Time // time of the last write, zero if unknown
+}
+
+// MapOption configures a PersistMap created by Map
+type MapOption func(*mapOptions)
+
+type mapOptions struct {
+	lazy       bool
+	maxPending int
+	timestamps bool
+	capacity   int
+	coalesce   time.Duration
+
+	readThrough        interface{} // func(key string) (T, bool)
+	readThroughPersist bool
+}
+
+// WithLazyDecode makes the map keep values loaded from the WAL as raw JSON and
+// unmarshal them on first access, caching the result.
+//
+// This trades per-access cost for much faster Open and lower memory usage when
+// only a small part of the data is accessed. Note that malformed values then don't
+// fail Open: they are logged and reported as missing by Get and skipped by Range,
+// while kept in the WAL as is. Writes replacing them report the decoding error to
+// the store's ErrorHandler.
+func WithLazyDecode() MapOption {
+	return func(o *mapOptions) {
+		o.lazy = true
+	}
+}
+
+// WithMaxPending caps the number of dirty keys awaiting the background sync.
+// Once an Async method makes the map reach the cap, it synchronously writes all
+// pending changes to the WAL before returning (backpressure).
+//
+// This bounds both memory usage and the amount of data lost on crash during
+// write bursts, as well as the stall of the next background sync.
+func WithMaxPending(n int) MapOption {
+	return func(o *mapOptions) {
+		o.maxPending = n
+	}
+}
+
+// WithTimestamps makes the map track the time of the last write of each key,
+// available with GetWithMeta. Timestamps are stored in the WAL records, so they
+// survive reopening. Keys loaded from records without a timestamp (e.g. written
+// before enabling the option, or adopted by AttachMap) have zero Meta.Modified.
+//
+// Timestamped values are written as "T" records, which versions of go-persist
+// before this option don't understand, so don't enable it on files that may still
+// be opened by older versions.
+//
+// InMemory methods don't update timestamps.
+func WithTimestamps() MapOption {
+	return func(o *mapOptions) {
+		o.timestamps = true
+	}
+}
+
+// WithInitialCapacity presizes the map for n keys, avoiding repeated growth of the
+// hash table when the map is bulk-populated. Maps are presized on Open by the number
+// of records in the WAL anyway, the larger of both is used.
+func WithInitialCapacity(n int) MapOption {
+	return func(o *mapOptions) {
+		o.capacity = n
+	}
+}
+
+// WithWriteCoalescing limits immediate writes (Set, Update and Delete) to one per
+// key per interval: a key written less than interval ago is only changed in memory
+// and marked dirty, like by the Async methods, so the background sync writes just
+// its latest value. This cuts the growth of the WAL for hot keys, e.g. a counter
+// updated thousands of times per second, while memory stays authoritative.
+//
+// Durability caveat: coalesced writes are lost on crash until the next background
+// sync (see WithSyncInterval), like changes of Async methods, even though Set
+// returned. FSync methods are never coalesced. The time of the last write is kept
+// for every written key.
+func WithWriteCoalescing(interval time.Duration) MapOption {
+	return func(o *mapOptions) {
+		o.coalesce = interval
+	}
+}
+
+// WithReadThrough makes Get (and GetMany, GetWithMeta) consult fetch on a miss,
+// e.g. to load the value from a slower remote database. Found values are cached
+// in the map like SetInMemory does, so the map acts as a cache in front of the source.
+// The type of fetch must match the map type, otherwise Map fails.
+//
+// Consistency implications:
+//   - fetch is called without locks, so concurrent misses of the same key may call it
+//     more than once. A value written to the map meanwhile wins over the fetched one.
+//   - Cached values are never refreshed from the source; Delete the key to refetch it.
+//   - Has, Range, Update and other methods see only cached values and don't call fetch.
+//   - Without WithReadThroughPersist fetched values aren't written to the WAL right away,
+//     but like SetInMemory values they are persisted by a Shrink or a later update of the key.
+func WithReadThrough[T any](fetch func(key string) (T, bool)) MapOption {
+	return func(o *mapOptions) {
+		o.readThrough = fetch
+	}
+}
+
+// WithReadThroughPersist makes values fetched by WithReadThrough persist like SetAsync,
+// so they survive reopening without being fetched again.
+func WithReadThroughPersist() MapOption {
+	return func(o *mapOptions) {
+		o.readThroughPersist = true
+	}
+}
+
+// lazyValue holds the raw JSON of a value that hasn't been decoded yet.
+// It marshals to itself, so it can be written back to the WAL as is.
+// Also used for orphan records, distinguishing raw JSON from values of type string.
+type lazyValue string
+
+func (v lazyValue) MarshalJSON() ([]byte, error) {
+	return []byte(v), nil
 }
 
 var (
 	ErrMapAlreadyExists = errors.New("persist map with the given name already exists in store")
 	ErrTooLate          = errors.New("cannot register new map after store has been loaded")
+	ErrInvalidMapName   = errors.New("map name must not contain a colon")
+	ErrMapTypeMismatch  = errors.New("persist map with the given name is registered with a different type")
 )
 
 // OpenSingleMap is the simplest way to get started with a persistent map when you need just one map per file.
 // It opens the store, compacts the WAL, and initializes the map in a single operation.
+// Auto-shrink is started with a one minute check interval and 1.8 ratio, use
+// OpenSingleMapWithOptions to tune or disable it.
 //
 // It returns a PersistMap that represents a thread-safe persistent key-value store with type-safe values of type T.
 // This map maintains an in-memory representation for fast access while ensuring durability through the WAL.
 func OpenSingleMap[T any](path string) (*PersistMap[T], error) {
-	store := New()
+	return OpenSingleMapWithOptions[T](path)
+}
+
+// OpenSingleMapWithOptions works like OpenSingleMap, applying opts to the underlying Store.
+// The defaults of OpenSingleMap are applied first, so opts override them, e.g.:
+//
+//	// Without background shrinking
+//	pm, err := persist.OpenSingleMapWithOptions[User]("users.db", persist.WithAutoShrink(0, 0))
+//
+// Options of the map itself are passed with WithSingleMapOptions.
+func OpenSingleMapWithOptions[T any](path string, opts ...Option) (*PersistMap[T], error) {
+	// Periodically optimize storage by default
+	store := New(append([]Option{WithAutoShrink(time.Minute, 1.8)}, opts...)...)
 
 	// Create a map with an empty namespace
-	pm, err := Map[T](store, "")
+	pm, err := Map[T](store, "", store.singleMapOptions...)
 	if err != nil {
 		return nil, err
 	}
@@ -50,9 +221,6 @@ func OpenSingleMap[T any](path string) (*PersistMap[T], error) {
 		return nil, err
 	}
 
-	// Periodically optimize storage
-	store.StartAutoShrink(time.Minute, 1.8)
-
 	return pm, nil
 }
 
@@ -62,51 +230,120 @@ func OpenSingleMap[T any](path string) (*PersistMap[T], error) {
 // It maintains an in-memory map for fast access while ensuring durability through the WAL.
 //
 // The mapName parameter is used as a namespace: keys will be stored as "mapName:key" in the WAL.
-func Map[T any](store *Store, mapName string) (*PersistMap[T], error) {
-	if err := ValidateKey(mapName); err != nil {
-		return nil, err
+// Records are routed to maps by the first colon, so keys may contain colons, but map names
+// may not (ErrInvalidMapName).
+//
+// Both map names and keys within a map may be empty: the key "" of the map "users" is
+// stored as "users:", and keys of the map "" as ":key". The map "" also receives full
+// keys without a colon, e.g. written by Store.Set. Full keys can't be
+// empty, so Store.Set("") fails, see ValidateKey.
+//
+// A map name can be registered only once per Store. A closed Store can't be reused,
+// so to reopen the same file create a new Store with New() and register the maps again.
+// Registering an existing name with another value type fails with ErrMapTypeMismatch.
+func Map[T any](store *Store, mapName string, opts ...MapOption) (*PersistMap[T], error) {
+	pm, _, err := AttachMap[T](store, mapName, opts...)
+	return pm, err
+}
+
+// AttachMap creates PersistMap like Map, explicitly adopting orphan records of the
+// store that belong to the mapName namespace. Returns the number of adopted records.
+//
+// Useful for the "inspect then formalize" workflow: read the store generically with
+// Get/RangeOrphans first, then attach a typed map to a namespace. If the store is
+// not loaded yet, nothing is adopted, as records will be loaded into the map on Open.
+func AttachMap[T any](store *Store, mapName string, opts ...MapOption) (pm *PersistMap[T], adopted int, err error) {
+	// The name may be empty, the full keys of the map always have the prefix
+	if err := ValidateKey(mapName + ":"); err != nil {
+		return nil, 0, err
+	}
+	if strings.Contains(mapName, ":") {
+		// Records are routed to maps by the first colon, so they would be loaded into another map
+		return nil, 0, ErrInvalidMapName
 	}
 
-	_, closed := store.closedMaps.Load(mapName)
-	if closed {
-		return nil, errors.New("cannot reuse a map that was previously closed")
+	if store.closed.Load() {
+		return nil, 0, ErrStoreClosed
 	}
 
-	_, found := store.persistMaps.Load(mapName)
-	if found {
-		return nil, ErrMapAlreadyExists
+	if existing, found := store.persistMaps.Load(mapName); found {
+		// Report a type mismatch explicitly, it's usually a bug rather than a double registration
+		registered := existing.(persistMapI).valueType()
+		if requested := reflect.TypeFor[T](); registered != requested {
+			return nil, 0, fmt.Errorf("%w: map %q holds %v, requested %v", ErrMapTypeMismatch, mapName, registered, requested)
+		}
+		return nil, 0, ErrMapAlreadyExists
 	}
 
-	pm := &PersistMap[T]{
-		Store:  store,
-		data:   xsync.NewMap(), // Using xsync.Map instead of built-in map
-		prefix: mapName + ":",  // Using "mapName:" as prefix for keys
-		dirty:  xsync.NewMap(), // Initialize dirty set
+	var options mapOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var fetch func(key string) (T, bool)
+	if options.readThrough != nil {
+		var ok bool
+		if fetch, ok = options.readThrough.(func(key string) (T, bool)); !ok {
+			return nil, 0, fmt.Errorf("read-through function %T doesn't match map type %v", options.readThrough, reflect.TypeFor[T]())
+		}
+	}
+
+	pm = &PersistMap[T]{
+		Store:      store,
+		prefix:     mapName + ":",   // Using "mapName:" as prefix for keys
+		dirty:      store.newMap(0), // Initialize dirty set
+		lazy:       options.lazy,
+		maxPending: options.maxPending,
+		capacity:   options.capacity,
+
+		readThrough:        fetch,
+		readThroughPersist: options.readThroughPersist,
+	}
+	pm.setValues(store.newMap(options.capacity))
+	if options.timestamps {
+		pm.times = xsync.NewMap()
+	}
+	if options.coalesce > 0 {
+		pm.coalesce = int64(options.coalesce)
+		pm.lastWrites = xsync.NewMap()
 	}
 
 	// Register this PersistMap instance in the Store registry
 	store.persistMaps.Store(mapName, pm)
 
 	// If the store is already loaded, process any orphan records for this map
-	var err error
 	if store.loaded {
-		store.orphanRecords.Range(func(key string, value interface{}) bool {
-			// Check if orphan key belongs to this map namespace
-			if strings.HasPrefix(key, pm.prefix) {
-				realKey := key[len(pm.prefix):]
-				// Process orphan record as a "set" record
-				if innerErr := pm.processRecord("S", realKey, value.(string)); innerErr != nil {
-					err = fmt.Errorf("error processing orphan record for key `%s`: %s", key, innerErr)
-					return false
-				}
-				// Delete processed orphan record
-				store.orphanRecords.Delete(key)
-			}
-			return true
-		})
+		adopted, err = pm.claimOrphans()
 	}
 
-	return pm, err
+	return pm, adopted, err
+}
+
+// claimOrphans moves orphan records belonging to this map's namespace into the map.
+// Returns the number of claimed records.
+func (pm *PersistMap[T]) claimOrphans() (int, error) {
+	var err error
+	claimed := 0
+	pm.Store.orphanRecords.Range(func(key string, value interface{}) bool {
+		// Check if orphan key belongs to this map namespace
+		if strings.HasPrefix(key, pm.prefix) {
+			realKey := key[len(pm.prefix):]
+			valueStr, innerErr := pm.Store.orphanToJSON(value)
+			if innerErr == nil {
+				// Process orphan record as a "set" record
+				innerErr = pm.processRecord("S", realKey, valueStr)
+			}
+			if innerErr != nil {
+				err = fmt.Errorf("error processing orphan record for key `%s`: %s", key, innerErr)
+				return false
+			}
+			// Delete processed orphan record
+			pm.Store.orphanRecords.Delete(key)
+			claimed++
+		}
+		return true
+	})
+	return claimed, err
 }
 
 // Sync writes all pending changes made by Async methods to the WAL file.
@@ -118,61 +355,296 @@ func Map[T any](store *Store, mapName string) (*PersistMap[T], error) {
 // memory and the WAL file, but doesn't guarantee data is physically
 // written to disk - that step is handled by the Store.Flush method.
 func (pm *PersistMap[T]) Sync() {
+	// Fast path for idle maps: Size is much cheaper than ranging over empty buckets
+	if pm.dirty.Size() == 0 {
+		return
+	}
 	// Iterate over dirty keys in the set
 	pm.dirty.Range(func(key string, _ interface{}) bool {
-		namespacedKey := pm.prefix + key
+		if err := pm.flushKey(key); err != nil {
+			pm.Store.logf("Background flush failed for key: %s error: %v", key, err)
+		}
+		return true
+	})
+}
 
-		pm.dirty.Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
-			// Lock is taken for this key. Now we can read the in-memory value
-			if v, ok := pm.data.Load(key); ok {
+// flushKey writes the current value of a dirty key to the WAL, or a delete record
+// if it no longer exists, and clears its dirty flag. Does nothing for clean keys.
+func (pm *PersistMap[T]) flushKey(key string) (err error) {
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	namespacedKey := pm.prefix + key
+	pm.dirty.Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		if !loaded {
+			// Already synced concurrently
+			return nil, true
+		}
+		// Lock is taken for this key. Now lock the in-memory value as well, so that
+		// the WAL write can't be reordered with a concurrent Set/Delete/Update of
+		// the same key, which would leave a stale value in the WAL
+		pm.values().Compute(key, func(value interface{}, exists bool) (interface{}, bool) {
+			if exists {
 				// Try persisting the current value in WAL
-				if err := pm.Store.write(namespacedKey, v); err != nil {
-					log.Println("go-persist: Background flush set failed for key:", key, "error:", err)
-					// Return oldValue and false, so that the dirty flag is not removed
-					return oldValue, false
-				}
-			} else {
-				// If the key is no longer in data, try to delete it from WAL
-				if err := pm.Store.Delete(namespacedKey); err != nil {
-					log.Println("go-persist: Background flush delete failed for key:", key, "error:", err)
-					return oldValue, false
-				}
+				err = pm.Store.writeAt(namespacedKey, value, pm.modified(key))
+				return value, false
 			}
-			// WAL update succeeded; return nil and true to delete the dirty flag
+			// If the key is no longer in data, try to delete it from WAL
+			err = pm.Store.deleteKey(namespacedKey)
 			return nil, true
 		})
-
-		return true
+		if err != nil {
+			// Return oldValue and false, so that the dirty flag is not removed
+			return oldValue, false
+		}
+		// WAL update succeeded; return nil and true to delete the dirty flag
+		return nil, true
 	})
+	return err
+}
+
+// SyncKey makes the current state of a single key durable, e.g. a payment that must
+// survive a crash before responding to a client, in an otherwise async workload:
+// a pending change of an Async method is written to the WAL, clearing the dirty
+// flag of the key only, and the WAL is fsynced. Other dirty keys are left to the
+// background sync, but changes of other keys already written to the WAL become
+// durable too.
+func (pm *PersistMap[T]) SyncKey(key string) error {
+	if err := pm.Store.checkOpen(); err != nil {
+		return err
+	}
+	if err := pm.flushKey(key); err != nil {
+		return err
+	}
+	s := pm.Store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return ErrStoreClosed
+	}
+	return s.syncFile()
+}
+
+// limitPending syncs the map immediately if the number of dirty keys reached maxPending
+func (pm *PersistMap[T]) limitPending() {
+	if pm.maxPending > 0 && pm.dirty.Size() >= pm.maxPending {
+		pm.Sync()
+	}
 }
 
 // processRecord applies a record from the WAL to the in-memory map
 func (pm *PersistMap[T]) processRecord(op, key, value string) error {
 	switch op {
+	case "T":
+		at, v, ok := splitTimestamp(value)
+		if !ok {
+			return errors.New("invalid timestamp")
+		}
+		if err := pm.processRecord("S", key, v); err != nil {
+			return err
+		}
+		if pm.times != nil {
+			pm.times.Store(key, at)
+		}
 	case "S":
+		pm.untouch(key)
+		if pm.lazy {
+			pm.values().Store(key, lazyValue(value))
+			return nil
+		}
 		var v T
-		if err := json.Unmarshal([]byte(value), &v); err != nil {
+		if err := pm.Store.decodeValue([]byte(value), &v); err != nil {
 			return err
 		}
-		pm.data.Store(key, v)
+		pm.values().Store(key, v)
 	case "D":
-		pm.data.Delete(key)
+		pm.values().Delete(key)
+		pm.untouch(key)
 	}
 	return nil
 }
 
-// writeRecords writes all the in-memory records of the PersistMap to the provided writer.
-// Each record is written as a "set" record in the WAL format.
-// Need for Shrink()
-func (pm *PersistMap[T]) writeRecords(w io.Writer) (int32, error) {
+// touch records now as the modification time of key and returns it in unix
+// nanoseconds, or 0 if timestamps are disabled.
+func (pm *PersistMap[T]) touch(key string) int64 {
+	if pm.times == nil {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	pm.times.Store(key, now)
+	return now
+}
+
+// untouch removes the modification time of key
+func (pm *PersistMap[T]) untouch(key string) {
+	if pm.times != nil {
+		pm.times.Delete(key)
+	}
+}
+
+// modified returns the modification time of key in unix nanoseconds, or 0 if unknown
+func (pm *PersistMap[T]) modified(key string) int64 {
+	if pm.times == nil {
+		return 0
+	}
+	at, _ := pm.times.Load(key)
+	at64, _ := at.(int64)
+	return at64
+}
+
+// typed converts a value stored in pm.data to T, decoding it if it's still lazy.
+// Decoding errors are reported to the store's ErrorHandler. Used by writes, which
+// replace the value anyway; reads use resolve instead.
+func (pm *PersistMap[T]) typed(value interface{}) T {
+	v, err := pm.decoded(value)
+	if err != nil {
+		pm.Store.ErrorHandler(err)
+	}
+	return v
+}
+
+// decoded converts a value stored in pm.data to T like typed, but returns the error
+// of decoding a lazy value
+func (pm *PersistMap[T]) decoded(value interface{}) (T, error) {
+	raw, ok := value.(lazyValue)
+	if !ok {
+		if value == nil {
+			// Nil values of interface types (e.g. any) are stored as nil interfaces
+			var zero T
+			return zero, nil
+		}
+		return value.(T), nil
+	}
+	var v T
+	if err := pm.Store.decodeValue([]byte(raw), &v); err != nil {
+		return v, fmt.Errorf("failed to decode value: %w", err)
+	}
+	return v, nil
+}
+
+// values returns the in-memory map, which is replaced as a whole by ReplaceAll
+func (pm *PersistMap[T]) values() ConcurrentMap {
+	return *pm.data.Load()
+}
+
+// setValues replaces the in-memory map
+func (pm *PersistMap[T]) setValues(data ConcurrentMap) {
+	pm.data.Store(&data)
+}
+
+// resolve decodes a lazy value for the key and caches the result in memory.
+// Returns false if the key was deleted concurrently, or if the value fails to
+// decode: then it's logged and kept raw, so the stored data isn't replaced.
+func (pm *PersistMap[T]) resolve(key string) (result T, exists bool) {
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		if !loaded {
+			return nil, true
+		}
+		v, err := pm.decoded(oldValue)
+		if err != nil {
+			pm.Store.logf("key `%s`: %v", pm.prefix+key, err)
+			return oldValue, false
+		}
+		result, exists = v, true
+		return result, false
+	})
+	return
+}
+
+// presize replaces the underlying empty in-memory map with one preallocated for
+// sizeHint entries. Used before bulk loading to avoid repeated rehashing.
+func (pm *PersistMap[T]) presize(sizeHint int) {
+	if pm.values().Size() == 0 && sizeHint > pm.capacity {
+		pm.setValues(pm.Store.newMap(sizeHint))
+	}
+}
+
+// reset removes all values and pending changes from memory, without touching the WAL.
+// Used to discard a partial load after a failed Open.
+func (pm *PersistMap[T]) reset() {
+	pm.values().Clear()
+	pm.dirty.Clear()
+	if pm.times != nil {
+		pm.times.Clear()
+	}
+}
+
+// valueType returns the type of values stored in the map.
+func (pm *PersistMap[T]) valueType() reflect.Type {
+	return reflect.TypeFor[T]()
+}
+
+// setJSON decodes a JSON-serialized value and sets it like Set, but returns errors
+// instead of passing them to the ErrorHandler. Need for Store.LoadJSON()
+func (pm *PersistMap[T]) setJSON(key, value string) error {
+	var v T
+	if err := pm.Store.decodeValue([]byte(value), &v); err != nil {
+		return err
+	}
 	var err error
-	var counter int32 = 0
-	pm.data.Range(func(key string, value interface{}) bool {
-		data, e := json.Marshal(value)
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		// Write S record to disk(page cache) immediately
+		if err = pm.Store.writeAt(pm.prefix+key, v, pm.touch(key)); err != nil {
+			return oldValue, !loaded
+		}
+		return v, false
+	})
+	return err
+}
+
+// mergeJSON sets the key to the encoded value incoming like setJSON, but if the key
+// exists and resolver is set, to the value returned by resolver, see Store.Import
+func (pm *PersistMap[T]) mergeJSON(key string, incoming []byte, resolver func(key string, existing, incoming []byte) []byte) error {
+	var err error
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		data := incoming
+		if loaded && resolver != nil {
+			var existing []byte
+			if existing, err = pm.Store.encodeValue(oldValue); err != nil {
+				return oldValue, false
+			}
+			if data = resolver(pm.prefix+key, existing, incoming); data == nil {
+				return oldValue, false
+			}
+		}
+		var v T
+		if err = pm.Store.decodeValue(data, &v); err != nil {
+			return oldValue, !loaded
+		}
+		// Write S record to disk(page cache) immediately
+		if err = pm.Store.writeAt(pm.prefix+key, v, pm.touch(key)); err != nil {
+			return oldValue, !loaded
+		}
+		return v, false
+	})
+	return err
+}
+
+// rangeJSON calls f for each in-memory record with its full key (including
+// pm.prefix) and JSON-serialized value. If f returns false, range stops the iteration.
+func (pm *PersistMap[T]) rangeJSON(f func(fullKey string, data []byte) bool) error {
+	var err error
+	pm.values().Range(func(key string, value interface{}) bool {
+		data, e := pm.Store.encodeValue(value)
 		if e != nil {
 			err = e
 			return false
 		}
+		return f(pm.prefix+key, data)
+	})
+	return err
+}
+
+// writeRecords writes all the in-memory records of the PersistMap to the provided writer.
+// Each record is written as a "set" record in the WAL format.
+// Need for Shrink()
+func (pm *PersistMap[T]) writeRecords(w io.Writer) (int32, error) {
+	var writeErr error
+	var counter int32 = 0
+	err := pm.rangeJSON(func(fullKey string, data []byte) bool {
 		// The record format consists of two lines:
 		// 1. S <key>
 		// 2. <json-serialized-value>
@@ -180,15 +652,21 @@ func (pm *PersistMap[T]) writeRecords(w io.Writer) (int32, error) {
 		// successfully written and can be safely processed during recovery.
 		//
 		// Full key is composed of pm.prefix "mapName:" plus the key
-		header := "S " + pm.prefix + key + "\n"
-		line := string(data) + "\n"
-		if _, e = w.Write([]byte(header + line)); e != nil {
-			err = e
+		var record string
+		if at := pm.modified(fullKey[len(pm.prefix):]); at != 0 {
+			record = pm.Store.formatRecord("T", fullKey, formatTimestamp(at, string(data)))
+		} else {
+			record = pm.Store.formatRecord("S", fullKey, string(data))
+		}
+		if _, writeErr = io.WriteString(w, record); writeErr != nil {
 			return false
 		}
 		counter++
 		return true
 	})
+	if writeErr != nil {
+		return counter, writeErr
+	}
 	return counter, err
 }
 
@@ -197,18 +675,148 @@ func (pm *PersistMap[T]) writeRecords(w io.Writer) (int32, error) {
 // Get retrieves the value associated with the key from the in-memory map.
 //
 // Returns the value and true if the key exists, or a zero value and false otherwise.
+// With WithReadThrough, a missing key is fetched from the source first.
 func (pm *PersistMap[T]) Get(key string) (T, bool) {
-	value, ok := pm.data.Load(key)
+	value, ok := pm.values().Load(key)
 	if !ok {
+		if pm.readThrough != nil {
+			return pm.fetch(key)
+		}
 		var zero T
 		return zero, false
 	}
-	// Type assertion to type T
-	typedValue, ok := value.(T)
+	if _, lazy := value.(lazyValue); lazy {
+		return pm.resolve(key)
+	}
+	return pm.typed(value), true
+}
+
+// GetRaw returns the value associated with the key encoded as in the WAL (usually
+// JSON), e.g. to serve it over HTTP as is. Returns nil and false if the key doesn't exist.
+//
+// Values are kept in memory decoded, so GetRaw encodes them on every call, costing
+// about as much as the decoding it saves. Only with WithLazyDecode, values not yet
+// accessed since loading are returned as stored, without a decode/encode round trip,
+// and stay undecoded. A value failing to encode is reported to the ErrorHandler.
+func (pm *PersistMap[T]) GetRaw(key string) ([]byte, bool) {
+	value, ok := pm.values().Load(key)
+	if !ok {
+		if pm.readThrough == nil {
+			return nil, false
+		}
+		if value, ok = pm.fetch(key); !ok {
+			return nil, false
+		}
+	}
+	if raw, lazy := value.(lazyValue); lazy {
+		return []byte(raw), true
+	}
+	data, err := pm.Store.encodeValue(value)
+	if err != nil {
+		pm.Store.ErrorHandler(fmt.Errorf("failed to encode value of key `%s`: %w", key, err))
+		return nil, false
+	}
+	return data, true
+}
+
+// fetch loads a missing key from the read-through source and caches it
+func (pm *PersistMap[T]) fetch(key string) (T, bool) {
+	value, ok := pm.readThrough(key)
 	if !ok {
-		panic("type assertion failed")
+		return value, false
+	}
+	stored := false
+	pm.replaceMu.RLock()
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		if loaded {
+			// Written concurrently while fetching, keep the local value
+			return oldValue, false
+		}
+		stored = true
+		if pm.readThroughPersist {
+			pm.touch(key)
+		}
+		return value, false
+	})
+	if stored && pm.readThroughPersist {
+		pm.dirty.Store(key, struct{}{})
+	}
+	pm.replaceMu.RUnlock()
+	if !stored {
+		return pm.Get(key)
 	}
-	return typedValue, true
+	if pm.readThroughPersist {
+		pm.limitPending()
+	}
+	return value, true
+}
+
+// GetMany retrieves the values of the given keys that exist in the map.
+func (pm *PersistMap[T]) GetMany(keys []string) map[string]T {
+	result := make(map[string]T, len(keys))
+	for _, key := range keys {
+		if value, ok := pm.Get(key); ok {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// ChangedSince returns the keys written after t, ordered by modification time.
+// Together with GetMany, it allows clients to poll for incremental changes.
+// Deleted keys are not reported.
+//
+// Requires WithTimestamps, otherwise returns nil. Scans all keys of the map.
+func (pm *PersistMap[T]) ChangedSince(t time.Time) []string {
+	if pm.times == nil {
+		return nil
+	}
+	since := t.UnixNano()
+	type change struct {
+		key string
+		at  int64
+	}
+	var changes []change
+	pm.times.Range(func(key string, value interface{}) bool {
+		if at := value.(int64); at > since {
+			changes = append(changes, change{key, at})
+		}
+		return true
+	})
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].at < changes[j].at
+	})
+	keys := make([]string, len(changes))
+	for i, c := range changes {
+		keys[i] = c.key
+	}
+	return keys
+}
+
+// GetWithMeta retrieves the value associated with the key like Get, along with its
+// metadata. The map must be created with WithTimestamps to track modification times.
+func (pm *PersistMap[T]) GetWithMeta(key string) (T, Meta, bool) {
+	value, ok := pm.Get(key)
+	if !ok {
+		return value, Meta{}, false
+	}
+	var meta Meta
+	if at := pm.modified(key); at != 0 {
+		meta.Modified = time.Unix(0, at)
+	}
+	return value, meta, true
+}
+
+// Has reports whether the key exists in the in-memory map.
+//
+// Unlike Get, it does not copy the value, which makes it cheaper for large T.
+//
+// Lookups of missing keys are cheaper than hits, as the hash table compares compact
+// per-slot hash fingerprints before touching any key, acting like a built-in filter.
+// So membership checks of mostly absent IDs don't need an extra bloom filter in front.
+func (pm *PersistMap[T]) Has(key string) bool {
+	_, ok := pm.values().Load(key)
+	return ok
 }
 
 // SetInMemory updates the value in memory only without explicitly writing to WAL
@@ -221,7 +829,9 @@ func (pm *PersistMap[T]) Get(key string) (T, bool) {
 //
 // Useful for non-exported, derived, or cached fields.
 func (pm *PersistMap[T]) SetInMemory(key string, value T) {
-	pm.data.Store(key, value)
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	pm.values().Store(key, value)
 }
 
 // UpdateInMemory atomically updates a value in memory only without writing to WAL
@@ -237,10 +847,12 @@ func (pm *PersistMap[T]) SetInMemory(key string, value T) {
 //
 // Useful for non-exported, derived, or cached fields.
 func (pm *PersistMap[T]) UpdateInMemory(key string, updater func(upd *Update[T])) T {
-	newValIface, _ := pm.data.Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	newValIface, _ := pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
 		var current T
 		if loaded {
-			current = oldValue.(T)
+			current = pm.typed(oldValue)
 		}
 		upd := &Update[T]{
 			Value:  current,
@@ -254,20 +866,69 @@ func (pm *PersistMap[T]) UpdateInMemory(key string, updater func(upd *Update[T])
 		}
 		return upd.Value, false
 	})
-	return newValIface.(T)
+	return pm.typed(newValIface)
 }
 
 /////////////////////////////////////////////////////////////////////////////////////////
 
+// coalesced reports whether an immediate write of key should be deferred like by
+// an Async method, as the key was written less than the coalescing interval ago,
+// see WithWriteCoalescing. Otherwise the write is recorded as the last one.
+func (pm *PersistMap[T]) coalesced(key string) bool {
+	if pm.lastWrites == nil {
+		return false
+	}
+	now := time.Now().UnixNano()
+	coalesced := false
+	pm.lastWrites.Compute(key, func(last interface{}, loaded bool) (interface{}, bool) {
+		if loaded && now-last.(int64) < pm.coalesce {
+			coalesced = true
+			return last, false
+		}
+		return now, false
+	})
+	return coalesced
+}
+
+// frozen reports ErrFrozen to the ErrorHandler if the store is frozen, see Store.Freeze
+func (pm *PersistMap[T]) frozen() bool {
+	if !pm.Store.frozen.Load() {
+		return false
+	}
+	pm.Store.ErrorHandler(ErrFrozen)
+	return true
+}
+
+// quiesced reports whether the store is quiesced, see Store.Quiesce. Unlike frozen,
+// it doesn't call the ErrorHandler: quiescing is expected, and methods using it
+// report rejected writes by their results.
+func (pm *PersistMap[T]) quiesced() bool {
+	return pm.Store.quiesced.Load()
+}
+
 // SetAsync updates the in-memory map and marks the key as dirty.
 //
 // Its actual persistence is deferred to a background flush, providing higher performance
 // at the cost of delayed durability.
 func (pm *PersistMap[T]) SetAsync(key string, value T) {
-	// Update in-memory xsync.Map
-	pm.data.Store(key, value)
+	if pm.frozen() {
+		return
+	}
+	pm.replaceMu.RLock()
+	// Update in-memory map
+	if pm.times != nil {
+		// Keep the value and its timestamp consistent under concurrent writes
+		pm.values().Compute(key, func(interface{}, bool) (interface{}, bool) {
+			pm.touch(key)
+			return value, false
+		})
+	} else {
+		pm.values().Store(key, value)
+	}
 	// Mark key as dirty
 	pm.dirty.Store(key, struct{}{}) // Faster than LoadOrStore
+	pm.replaceMu.RUnlock()
+	pm.limitPending()
 }
 
 // Set updates both in-memory data and WAL file immediately, but without fsync.
@@ -275,68 +936,578 @@ func (pm *PersistMap[T]) SetAsync(key string, value T) {
 // Safe for application crashes, as WAL ensures recovery, but may lose updates
 // during system crashes if data remains in OS cache.
 func (pm *PersistMap[T]) Set(key string, value T) {
-	pm.data.Compute(key, func(oldValue interface{}, loaded bool) (newValue interface{}, delete bool) {
-		namespacedKey := pm.prefix + key
-		// Write S record to disk(page cache) immediately
-		if err := pm.Store.write(namespacedKey, value); err != nil {
-			pm.Store.ErrorHandler(err)
-		}
-		// Update in-memory xsync.Map
-		return value, false
-	})
+	if err := pm.set(key, value, false); err != nil {
+		pm.Store.ErrorHandler(err)
+	}
 }
 
 // SetFSync updates in-memory data, WAL file, and forces physical disk write with fsync.
 //
 // Most durable option that protects against both application and system crashes,
-// but with highest performance cost.
+// but with highest performance cost. The write and fsync happen under a single
+// acquisition of the store lock. Unlike Set, write errors are returned instead of
+// being passed to the ErrorHandler.
 func (pm *PersistMap[T]) SetFSync(key string, value T) error {
-	pm.Set(key, value)
-	// Flush (fsync) to ensure durability
-	pm.Store.mu.Lock()
-	defer pm.Store.mu.Unlock()
-	return pm.Store.f.Sync()
+	return pm.set(key, value, true)
+}
+
+// set implements Set and SetFSync
+func (pm *PersistMap[T]) set(key string, value T, fsync bool) (err error) {
+	if pm.Store.frozen.Load() {
+		return ErrFrozen
+	}
+	if pm.Store.quiesced.Load() {
+		return ErrQuiesced
+	}
+	if !fsync && pm.coalesced(key) {
+		pm.SetAsync(key, value)
+		return nil
+	}
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (newValue interface{}, delete bool) {
+		// Write S record to disk(page cache) immediately
+		err = pm.Store.writeAndSync(pm.prefix+key, value, pm.touch(key), fsync)
+		if errors.Is(err, ErrQuiesced) {
+			// Quiesced concurrently, keep the map unchanged
+			return oldValue, !loaded
+		}
+		// Update in-memory map
+		return value, false
+	})
+	return
+}
+
+// SetIfAbsent stores the value and writes it to the WAL immediately, like Set, but
+// only if the key doesn't exist. Returns true if the value was stored, false if the
+// key already existed, in which case nothing is written. Useful for claiming unique
+// keys, as of concurrent calls for the same key exactly one succeeds.
+func (pm *PersistMap[T]) SetIfAbsent(key string, value T) (stored bool) {
+	if pm.frozen() || pm.quiesced() {
+		return false
+	}
+	var err error
+	pm.replaceMu.RLock()
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		if loaded {
+			return oldValue, false
+		}
+		// Write S record to disk(page cache) immediately
+		err = pm.Store.writeAndSync(pm.prefix+key, value, pm.touch(key), false)
+		if errors.Is(err, ErrQuiesced) {
+			// Quiesced concurrently, reported by stored being false
+			return oldValue, true
+		}
+		stored = true
+		return value, false
+	})
+	pm.replaceMu.RUnlock()
+	if err != nil && !errors.Is(err, ErrQuiesced) {
+		pm.Store.ErrorHandler(err)
+	}
+	return
 }
 
 // DeleteAsync removes the key from the in-memory map and marks it as dirty for background flush
 // Returns true if the key existed and was deleted
 func (pm *PersistMap[T]) DeleteAsync(key string) (existed bool) {
-	// Remove the key from the in-memory xsync.Map
-	pm.data.Compute(key, func(value interface{}, loaded bool) (interface{}, bool) {
+	if pm.frozen() {
+		return false
+	}
+	pm.replaceMu.RLock()
+	// Remove the key from the in-memory map
+	pm.values().Compute(key, func(value interface{}, loaded bool) (interface{}, bool) {
 		existed = loaded
+		pm.untouch(key)
 		return value, true
 	})
 	// Mark the key as dirty
 	pm.dirty.Store(key, struct{}{})
+	pm.replaceMu.RUnlock()
+	pm.limitPending()
 	return
 }
 
 // Delete immediately deletes the key from both WAL and in-memory map
 // Returns true if the key existed and was deleted
 func (pm *PersistMap[T]) Delete(key string) (existed bool) {
-	pm.data.Compute(key, func(oldValue interface{}, loaded bool) (newValue interface{}, delete bool) {
+	existed, err := pm.delete(key, false)
+	if err != nil {
+		pm.Store.ErrorHandler(err)
+	}
+	return
+}
+
+// delete implements Delete and DeleteFSync, fsyncing only if the key existed
+func (pm *PersistMap[T]) delete(key string, fsync bool) (existed bool, err error) {
+	if pm.Store.frozen.Load() {
+		return pm.Has(key), ErrFrozen
+	}
+	if pm.Store.quiesced.Load() {
+		return pm.Has(key), ErrQuiesced
+	}
+	if !fsync && pm.coalesced(key) {
+		return pm.DeleteAsync(key), nil
+	}
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (newValue interface{}, delete bool) {
 		existed = loaded
-		namespacedKey := pm.prefix + key
 		// Write D record to disk(page cache) immediately
-		if err := pm.Store.Delete(namespacedKey); err != nil {
+		err = pm.Store.deleteAndSync(pm.prefix+key, fsync && loaded)
+		if errors.Is(err, ErrQuiesced) {
+			return oldValue, !loaded
+		}
+		// Remove the key from the in-memory map
+		pm.untouch(key)
+		return oldValue, true
+	})
+	return
+}
+
+// Pop atomically removes the key and returns the value it held, writing a delete
+// record to the WAL immediately, like Delete. Returns a zero value and false if the
+// key doesn't exist, in which case nothing is written.
+//
+// Unlike Get followed by Delete, concurrent Pops of the same key never return the
+// same value twice, which makes it suitable for work queues.
+func (pm *PersistMap[T]) Pop(key string) (value T, existed bool) {
+	if pm.frozen() || pm.quiesced() {
+		return
+	}
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		if !loaded {
+			return oldValue, true
+		}
+		// Write D record to disk(page cache) immediately
+		if err := pm.Store.deleteKey(pm.prefix + key); err != nil {
+			if errors.Is(err, ErrQuiesced) {
+				// Quiesced concurrently, keep the key, reported by existed being false
+				return oldValue, false
+			}
 			pm.Store.ErrorHandler(err)
 		}
-		// Remove the key from the in-memory xsync.Map
+		existed = true
+		value = pm.typed(oldValue)
+		pm.untouch(key)
 		return oldValue, true
 	})
 	return
 }
 
+// Rename moves the value of oldKey to newKey, overwriting newKey if it exists.
+// Returns false if oldKey doesn't exist.
+//
+// The set of newKey and the delete of oldKey are written to the WAL as a single
+// block, so after a crash the value is never lost: at worst, if the write was torn,
+// both keys exist. In memory, newKey is set first and oldKey is removed right after,
+// so concurrent readers may briefly see both keys, but never neither.
+// For values of non-comparable types (e.g. slices), an extra delete record of oldKey
+// is written, as a concurrent write to it can't be told apart from the renamed value.
+func (pm *PersistMap[T]) Rename(oldKey, newKey string) (renamed bool) {
+	if pm.frozen() || pm.quiesced() {
+		return false
+	}
+	if oldKey == newKey {
+		return pm.Has(oldKey)
+	}
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	var moved interface{}
+	pm.values().Compute(newKey, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		value, ok := pm.values().Load(oldKey)
+		if !ok {
+			// Nothing to rename, keep newKey as is
+			return oldValue, !loaded
+		}
+		// Write S and D records to disk(page cache) at once
+		err := pm.Store.rename(pm.prefix+oldKey, pm.prefix+newKey, value, pm.touch(newKey))
+		if errors.Is(err, ErrQuiesced) {
+			// Quiesced concurrently, keep both keys as is
+			return oldValue, !loaded
+		}
+		if err != nil {
+			pm.Store.ErrorHandler(err)
+		}
+		renamed = true
+		moved = value
+		return value, false
+	})
+	if !renamed {
+		return false
+	}
+
+	pm.values().Compute(oldKey, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+		if loaded && !sameValue(oldValue, moved) {
+			// Written concurrently after the rename records, record the delete again
+			// to keep the WAL consistent with memory
+			if err := pm.Store.deleteKey(pm.prefix + oldKey); err != nil {
+				pm.Store.ErrorHandler(err)
+			}
+		}
+		pm.untouch(oldKey)
+		return oldValue, true
+	})
+	return true
+}
+
+// sameValue reports whether a and b are the same stored value. Values of types
+// that can't be compared are reported as different.
+func sameValue(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() || !va.Comparable() {
+		return false
+	}
+	return va.Equal(vb)
+}
+
+// Batch sizes of LoadFrom, in bytes of formatted records
+const (
+	loadBatchSize = 1 << 20  // records written to the WAL at once
+	loadFSyncSize = 64 << 20 // records written between fsyncs
+)
+
+// LoadFrom bulk-loads key-value pairs from seq, e.g. a CSV reader or a database cursor.
+// Records are written to the WAL in large batches instead of a write call per key,
+// with an fsync every 64MB and at the end. Returns the number of loaded pairs;
+// to report progress, count the pairs yielded by seq.
+//
+// Loading stops at the first error (e.g. an invalid key or a value failing to encode).
+// Pairs before the failed one are loaded, but those of the last batch may not be fsynced.
+// Values become visible in memory once their batch is written, so concurrent writes to
+// the same keys while LoadFrom is running may be ordered differently in memory and in the WAL.
+func (pm *PersistMap[T]) LoadFrom(seq iter.Seq2[string, T]) (n int, err error) {
+	if err := pm.Store.checkOpen(); err != nil {
+		return 0, err
+	}
+	if pm.Store.frozen.Load() {
+		return 0, ErrFrozen
+	}
+	if pm.Store.quiesced.Load() {
+		return 0, ErrQuiesced
+	}
+	type pair struct {
+		key   string
+		value T
+		at    int64
+	}
+	var (
+		batch     []pair
+		records   []string
+		batchSize int
+		unsynced  int
+	)
+	// flush writes the batch to the WAL, then stores its values in memory
+	flush := func(fsync bool) error {
+		if len(records) > 0 {
+			pm.replaceMu.RLock()
+			if err := pm.Store.appendRecords(false, records...); err != nil {
+				pm.replaceMu.RUnlock()
+				return err
+			}
+			for _, p := range batch {
+				pm.values().Store(p.key, p.value)
+				if p.at != 0 {
+					pm.times.Store(p.key, p.at)
+				}
+			}
+			pm.replaceMu.RUnlock()
+			n += len(batch)
+			unsynced += batchSize
+			batch, records, batchSize = batch[:0], records[:0], 0
+		}
+		if fsync && unsynced > 0 {
+			unsynced = 0
+			pm.Store.mu.Lock()
+			defer pm.Store.mu.Unlock()
+			if pm.Store.closed.Load() {
+				return ErrStoreClosed
+			}
+			return pm.Store.syncFile()
+		}
+		return nil
+	}
+
+	for key, value := range seq {
+		var at int64
+		if pm.times != nil {
+			at = time.Now().UnixNano()
+		}
+		var record string
+		record, err = pm.Store.setRecord(pm.prefix+key, value, at)
+		if err != nil {
+			err = fmt.Errorf("failed loading key `%s`: %w", key, err)
+			break
+		}
+		batch = append(batch, pair{key, value, at})
+		records = append(records, record)
+		batchSize += len(record)
+		if batchSize >= loadBatchSize {
+			if err = flush(unsynced+batchSize >= loadFSyncSize); err != nil {
+				return n, err
+			}
+		}
+	}
+	if flushErr := flush(true); err == nil {
+		err = flushErr
+	}
+	return n, err
+}
+
+// ReplaceAll atomically replaces the whole contents of the map with newData, e.g. to
+// publish a rebuilt lookup table. Delete records of the keys absent from newData and
+// set records of all its keys are written to the WAL as a single block and fsynced,
+// then the in-memory map is swapped at once: concurrent readers see either the old or
+// the new contents, never a mix. Writes to the map (including Async ones) block until
+// the swap is done, so they are applied either entirely before or entirely after it;
+// pending changes of Async methods are superseded. ReplaceAll must not be called from
+// an updater or Range callback of the same map, as it would deadlock.
+//
+// If any key is invalid or any value fails to encode, nothing is written and the map
+// is left unchanged. Like with Rename, a crash in the middle of the write may leave a
+// prefix of the block in the WAL; the WAL doesn't support multi-record transactions.
+func (pm *PersistMap[T]) ReplaceAll(newData map[string]T) error {
+	if err := pm.Store.checkOpen(); err != nil {
+		return err
+	}
+	if pm.Store.frozen.Load() {
+		return ErrFrozen
+	}
+	if pm.Store.quiesced.Load() {
+		return ErrQuiesced
+	}
+	var at int64
+	if pm.times != nil {
+		at = time.Now().UnixNano()
+	}
+	// Encode values before blocking writers
+	records := make([]string, 0, len(newData))
+	for key, value := range newData {
+		record, err := pm.Store.setRecord(pm.prefix+key, value, at)
+		if err != nil {
+			return fmt.Errorf("failed to replace key `%s`: %w", key, err)
+		}
+		records = append(records, record)
+	}
+
+	pm.replaceMu.Lock()
+	defer pm.replaceMu.Unlock()
+	var deletes []string
+	absent := func(key string, _ interface{}) bool {
+		if _, ok := newData[key]; !ok {
+			deletes = append(deletes, pm.Store.formatRecord("D", pm.prefix+key, ""))
+		}
+		return true
+	}
+	pm.values().Range(absent)
+	// Deletes by Async methods not written yet
+	pm.dirty.Range(func(key string, _ interface{}) bool {
+		if _, ok := pm.values().Load(key); !ok {
+			return absent(key, nil)
+		}
+		return true
+	})
+	if records = append(deletes, records...); len(records) > 0 {
+		if err := pm.Store.appendRecords(true, records...); err != nil {
+			return err
+		}
+	}
+
+	data := pm.Store.newMap(max(len(newData), pm.capacity))
+	for key, value := range newData {
+		data.Store(key, value)
+	}
+	if pm.times != nil {
+		pm.times.Clear()
+		for key := range newData {
+			pm.times.Store(key, at)
+		}
+	}
+	pm.dirty.Clear()
+	pm.setValues(data)
+	return nil
+}
+
+// DeleteMany removes all given keys from the in-memory map and writes their delete
+// records to the WAL in a single block, avoiding a syscall per key.
+// Returns the number of keys that existed.
+//
+// Other writes to the map block until the records are written and the keys are
+// removed, so concurrent writes to the same keys are ordered the same way in memory
+// and in the WAL. If the write fails, no keys are removed and the error is passed
+// to the ErrorHandler, unless it's ErrQuiesced. DeleteMany must not be called from an updater or Range
+// callback of the same map, as it would deadlock.
+func (pm *PersistMap[T]) DeleteMany(keys []string) (deleted int) {
+	if pm.frozen() || pm.quiesced() {
+		return 0
+	}
+	pm.replaceMu.Lock()
+	defer pm.replaceMu.Unlock()
+	existing := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := pm.values().Load(key); ok {
+			existing[key] = struct{}{}
+		}
+	}
+	return pm.deleteExisting(existing)
+}
+
+// deleteExisting writes delete records of keys in a single block, then removes them
+// from memory. pm.replaceMu must be held for writing, so the keys can't change meanwhile.
+func (pm *PersistMap[T]) deleteExisting(keys map[string]struct{}) int {
+	namespacedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		namespacedKeys = append(namespacedKeys, pm.prefix+key)
+	}
+	// Write all D records to disk(page cache) at once
+	if err := pm.Store.deleteMany(namespacedKeys); err != nil {
+		if !errors.Is(err, ErrQuiesced) {
+			pm.Store.ErrorHandler(err)
+		}
+		return 0
+	}
+	for key := range keys {
+		pm.values().Delete(key)
+		pm.untouch(key)
+	}
+	return len(keys)
+}
+
+// DeleteWhere removes all keys whose values match pred, writing their delete records
+// to the WAL in a single block like DeleteMany. Returns the number of deleted keys.
+//
+// Candidates are collected with Range, then pred is evaluated again for each of them
+// while other writes to the map are blocked, like by DeleteMany, so a value changed
+// concurrently to no longer match is kept. pred must not modify the map.
+func (pm *PersistMap[T]) DeleteWhere(pred func(key string, value T) bool) (deleted int) {
+	if pm.frozen() || pm.quiesced() {
+		return 0
+	}
+	var candidates []string
+	pm.Range(func(key string, value T) bool {
+		if pred(key, value) {
+			candidates = append(candidates, key)
+		}
+		return true
+	})
+	if len(candidates) == 0 {
+		return 0
+	}
+
+	pm.replaceMu.Lock()
+	defer pm.replaceMu.Unlock()
+	matching := make(map[string]struct{}, len(candidates))
+	for _, key := range candidates {
+		value, ok := pm.values().Load(key)
+		if !ok {
+			// Deleted concurrently
+			continue
+		}
+		if v, err := pm.decoded(value); err == nil && pred(key, v) {
+			matching[key] = struct{}{}
+		}
+	}
+	return pm.deleteExisting(matching)
+}
+
+// RangeUpdate applies updater to every key of the map, like Update does for a single
+// key, and writes each change to the WAL immediately (without fsync). Useful for bulk
+// migrations, e.g. changing a field of all values. upd.Exists is always true, the
+// supported actions are the same as for Update. Returns the number of keys set or deleted.
+//
+// Keys are collected with Range first, then each one is updated under its lock, with
+// its record written inside the lock like by Update, so concurrent writes to the same
+// keys are ordered the same way in memory and in the WAL. Keys added concurrently may
+// be missed, and keys deleted meanwhile are skipped.
+//
+// Values that fail to encode are kept unchanged, and the first such error is returned
+// after the other keys are processed. A failed WAL write keeps the key unchanged and
+// stops the iteration.
+func (pm *PersistMap[T]) RangeUpdate(updater func(key string, upd *Update[T])) (updated int, err error) {
+	if err := pm.Store.checkOpen(); err != nil {
+		return 0, err
+	}
+	if pm.Store.frozen.Load() {
+		return 0, ErrFrozen
+	}
+	if pm.Store.quiesced.Load() {
+		return 0, ErrQuiesced
+	}
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	var keys []string
+	pm.values().Range(func(key string, _ interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	var encodeErr, writeErr error
+	for _, key := range keys {
+		pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+			if !loaded {
+				// Deleted concurrently, keep it absent
+				return oldValue, true
+			}
+			current := pm.typed(oldValue)
+			upd := &Update[T]{
+				Value:  current,
+				Exists: true,
+				action: actionSet,
+			}
+			updater(key, upd)
+
+			switch upd.action {
+			case actionDelete:
+				// Write D record inside the lock, like update
+				if writeErr = pm.Store.appendRecords(false, pm.Store.formatRecord("D", pm.prefix+key, "")); writeErr != nil {
+					return oldValue, false
+				}
+				pm.untouch(key)
+				updated++
+				return oldValue, true
+			case actionSet:
+				if upd.unchanged(current) {
+					return oldValue, false
+				}
+				record, err := pm.Store.setRecord(pm.prefix+key, upd.Value, pm.touch(key))
+				if err != nil {
+					if encodeErr == nil {
+						encodeErr = fmt.Errorf("failed to update key `%s`: %w", key, err)
+					}
+					return oldValue, false
+				}
+				if writeErr = pm.Store.appendRecords(false, record); writeErr != nil {
+					return oldValue, false
+				}
+				updated++
+				return upd.Value, false
+			default:
+				return oldValue, false
+			}
+		})
+		if writeErr != nil {
+			return updated, writeErr
+		}
+	}
+	return updated, encodeErr
+}
+
 // DeleteFSync writes a delete record to WAL immediately, flushes to disk (fsync),
 // and updates the in-memory map.
 func (pm *PersistMap[T]) DeleteFSync(key string) error {
-	if !pm.Delete(key) {
+	existed, err := pm.delete(key, true)
+	if err != nil {
+		return err
+	}
+	if !existed {
 		return ErrKeyNotFound
 	}
-	// Flush (fsync) to ensure durability
-	pm.Store.mu.Lock()
-	defer pm.Store.mu.Unlock()
-	return pm.Store.f.Sync()
+	return nil
 }
 
 /////////////////////////////////////////////////////////////////////////////////////////
@@ -347,9 +1518,10 @@ func (pm *PersistMap[T]) DeleteFSync(key string) error {
 // By default, the action is set to update, so modifying the Value field directly
 // implies a "set" operation.
 type Update[T any] struct {
-	Value  T          // Current value retrieved from the map
-	Exists bool       // Whether the key exists
-	action actionType // The chosen action
+	Value         T          // Current value retrieved from the map
+	Exists        bool       // Whether the key exists
+	action        actionType // The chosen action
+	skipUnchanged bool       // Skip persisting if the new value equals the old one
 }
 
 type actionType int
@@ -379,6 +1551,22 @@ func (ua *Update[T]) Cancel() {
 	ua.action = actionCancel
 }
 
+// SkipIfUnchanged makes a "set" action behave like Cancel when the new value is
+// deeply equal (reflect.DeepEqual) to the current one, so no-op updates don't
+// grow the WAL. It's opt-in because the comparison may cost more than the write
+// for large values.
+//
+// The comparison is only meaningful if the updater doesn't mutate data shared
+// with the current value (e.g. through pointers, slices or maps in T).
+func (ua *Update[T]) SkipIfUnchanged() {
+	ua.skipUnchanged = true
+}
+
+// unchanged reports whether a "set" action can be skipped as a no-op
+func (ua *Update[T]) unchanged(current T) bool {
+	return ua.skipUnchanged && ua.Exists && reflect.DeepEqual(current, ua.Value)
+}
+
 // UpdateAsync atomically updates a key using the updater function.
 //
 // It only updates the in-memory value and marks the key as dirty so that background FSyncAll
@@ -394,13 +1582,20 @@ func (ua *Update[T]) Cancel() {
 //
 // - Call upd.Cancel() to keep the original value unchanged
 //
+// - Call upd.SkipIfUnchanged() to avoid persisting a value equal to the current one
+//
 // This method locks the relevant hash table bucket during execution, so avoid long-running
 // operations in the updater function to prevent blocking other bucket operations.
 func (pm *PersistMap[T]) UpdateAsync(key string, updater func(upd *Update[T])) (newValue T, exists bool) {
-	newValIface, ok := pm.data.Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+	if pm.frozen() {
+		return pm.Get(key)
+	}
+	changed := true
+	pm.replaceMu.RLock()
+	newValIface, ok := pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
 		var current T
 		if loaded {
-			current = oldValue.(T)
+			current = pm.typed(oldValue)
 		}
 		upd := &Update[T]{
 			Value:  current,
@@ -412,9 +1607,15 @@ func (pm *PersistMap[T]) UpdateAsync(key string, updater func(upd *Update[T])) (
 		switch upd.action {
 		case actionDelete:
 			// Mark key for deletion (Compute returns delete flag)
+			pm.untouch(key)
 			return nil, true
 		case actionSet:
+			if upd.unchanged(current) {
+				changed = false
+				return oldValue, false
+			}
 			// Set new value
+			pm.touch(key)
 			return upd.Value, false
 		default:
 			// If cancelled, return the original value and state
@@ -422,13 +1623,19 @@ func (pm *PersistMap[T]) UpdateAsync(key string, updater func(upd *Update[T])) (
 		}
 	})
 	// Mark the key as dirty for asynchronous persistence
-	pm.dirty.Store(key, struct{}{})
+	if changed {
+		pm.dirty.Store(key, struct{}{})
+	}
+	pm.replaceMu.RUnlock()
+	if changed {
+		pm.limitPending()
+	}
 
 	if !ok {
 		var zero T
 		return zero, false
 	}
-	return newValIface.(T), true
+	return pm.typed(newValIface), true
 }
 
 // Update atomically updates the value for the given key using the updater function,
@@ -444,13 +1651,71 @@ func (pm *PersistMap[T]) UpdateAsync(key string, updater func(upd *Update[T])) (
 //
 // - Call upd.Cancel() to keep the original value unchanged
 //
+// - Call upd.SkipIfUnchanged() to avoid persisting a value equal to the current one
+//
 // This method locks the relevant hash table bucket during execution, so avoid long-running
 // operations in the updater function to prevent blocking other bucket operations.
 func (pm *PersistMap[T]) Update(key string, updater func(upd *Update[T])) (newValue T, exists bool) {
-	newValIface, ok := pm.data.Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
+	newValue, exists, err := pm.update(key, updater, false)
+	if err != nil {
+		pm.Store.ErrorHandler(err)
+	}
+	return
+}
+
+// UpdateIf works like Update, but runs the updater only if cond returns true for the
+// current value, checked under the same bucket lock. Otherwise the update is cancelled
+// and nothing is written. Returns whether the update was applied, i.e. cond held,
+// the updater didn't cancel it, nor was it skipped by SkipIfUnchanged, and it was
+// written to the WAL. A failed write is passed to the ErrorHandler, unless it's
+// ErrQuiesced.
+//
+// Useful for conditional state transitions, where most updates are no-ops:
+//
+//	applied := jobs.UpdateIf(id, func(job Job, exists bool) bool {
+//	    return exists && job.State == "queued"
+//	}, func(upd *persist.Update[Job]) {
+//	    upd.Value.State = "running"
+//	})
+func (pm *PersistMap[T]) UpdateIf(key string, cond func(current T, exists bool) bool, updater func(upd *Update[T])) (applied bool) {
+	_, _, err := pm.update(key, func(upd *Update[T]) {
+		if !cond(upd.Value, upd.Exists) {
+			upd.Cancel()
+			return
+		}
+		current := upd.Value
+		updater(upd)
+		applied = upd.action != actionCancel && !(upd.action == actionSet && upd.unchanged(current))
+	}, false)
+	if err != nil {
+		if !errors.Is(err, ErrQuiesced) {
+			pm.Store.ErrorHandler(err)
+		}
+		return false
+	}
+	return applied
+}
+
+// update implements Update and UpdateFSync, returning the write error
+func (pm *PersistMap[T]) update(key string, updater func(upd *Update[T]), fsync bool) (newValue T, exists bool, err error) {
+	if pm.Store.frozen.Load() {
+		newValue, exists = pm.Get(key)
+		return newValue, exists, ErrFrozen
+	}
+	if pm.Store.quiesced.Load() {
+		newValue, exists = pm.Get(key)
+		return newValue, exists, ErrQuiesced
+	}
+	if !fsync && pm.coalesced(key) {
+		newValue, exists = pm.UpdateAsync(key, updater)
+		return newValue, exists, nil
+	}
+	pm.replaceMu.RLock()
+	defer pm.replaceMu.RUnlock()
+	newValIface, ok := pm.values().Compute(key, func(oldValue interface{}, loaded bool) (interface{}, bool) {
 		var current T
 		if loaded {
-			current = oldValue.(T)
+			current = pm.typed(oldValue)
 		}
 		upd := &Update[T]{
 			Value:  current,
@@ -463,15 +1728,23 @@ func (pm *PersistMap[T]) Update(key string, updater func(upd *Update[T])) (newVa
 		switch upd.action {
 		case actionDelete:
 			// Write D record atomically inside Compute callback
-			if err := pm.Store.Delete(namespacedKey); err != nil {
-				pm.Store.ErrorHandler(err)
+			err = pm.Store.deleteAndSync(namespacedKey, fsync)
+			if errors.Is(err, ErrQuiesced) {
+				// Quiesced concurrently, keep the map unchanged
+				return oldValue, !loaded
 			}
+			pm.untouch(key)
 			// Returning true signals removal of the key from the map
 			return nil, true
 		case actionSet:
+			if upd.unchanged(current) {
+				// Nothing to persist, keep the original value
+				return oldValue, false
+			}
 			// Write S record atomically inside Compute callback
-			if err := pm.Store.write(namespacedKey, upd.Value); err != nil {
-				pm.Store.ErrorHandler(err)
+			err = pm.Store.writeAndSync(namespacedKey, upd.Value, pm.touch(key), fsync)
+			if errors.Is(err, ErrQuiesced) {
+				return oldValue, !loaded
 			}
 			// Returning false signals that the key should be kept in the map
 			return upd.Value, false
@@ -481,10 +1754,9 @@ func (pm *PersistMap[T]) Update(key string, updater func(upd *Update[T])) (newVa
 		}
 	})
 	if !ok {
-		var zero T
-		return zero, false
+		return newValue, false, err
 	}
-	return newValIface.(T), true
+	return pm.typed(newValIface), true, err
 }
 
 // UpdateFSync atomically updates a key using the updater function, writes to the WAL, and forces a physical disk flush (fsync).
@@ -501,22 +1773,80 @@ func (pm *PersistMap[T]) Update(key string, updater func(upd *Update[T])) (newVa
 //
 // - Call upd.Cancel() to keep the original value unchanged
 //
+// - Call upd.SkipIfUnchanged() to avoid persisting a value equal to the current one
+//
 // This method locks the relevant hash table bucket during execution, so avoid long-running
 // operations in the updater function to prevent blocking other bucket operations.
+//
+// The write and fsync happen under a single acquisition of the store lock, nothing is
+// synced if the update was cancelled or skipped. Unlike Update, write errors are returned
+// instead of being passed to the ErrorHandler.
 func (pm *PersistMap[T]) UpdateFSync(key string, updater func(upd *Update[T])) (newValue T, exists bool, err error) {
-	newValue, exists = pm.Update(key, updater)
-	// Flush (fsync) to ensure durability
-	pm.Store.mu.Lock()
-	defer pm.Store.mu.Unlock()
-	err = pm.Store.f.Sync()
-	return
+	return pm.update(key, updater, true)
 }
 
 /////////////////////////////////////////////////////////////////////////////////////////
 
 // Size returns current size of the map
 func (pm *PersistMap[T]) Size() int {
-	return pm.data.Size()
+	return pm.values().Size()
+}
+
+// Name returns the name the map was registered with, empty for OpenSingleMap
+func (pm *PersistMap[T]) Name() string {
+	return strings.TrimSuffix(pm.prefix, ":")
+}
+
+// RangeRaw calls f for each key with its value encoded as in the WAL (usually JSON),
+// like Range, but without knowing T, see AnyMap. If f returns false, range stops
+// the iteration. Returns an error if a value fails to encode.
+func (pm *PersistMap[T]) RangeRaw(f func(key, rawValue string) bool) error {
+	return pm.rangeJSON(func(fullKey string, data []byte) bool {
+		return f(fullKey[len(pm.prefix):], string(data))
+	})
+}
+
+// Parameters of ApproxMemoryBytes
+const (
+	memorySampleSize    = 1000 // number of entries measured
+	memoryEntryOverhead = 64   // bytes per entry for the hash table slot, key header and boxed value
+	memoryTimeOverhead  = 48   // bytes per entry of the timestamps map, see WithTimestamps
+)
+
+// ApproxMemoryBytes returns a rough estimate of the memory used by the map, e.g. to
+// decide when to evict keys or shard the data, as all values are kept in RAM.
+//
+// Values are measured by their serialized size, which may differ considerably from
+// their in-memory representation (e.g. pointers, unused slice capacity). For large
+// maps, only a sample of the entries is measured and extrapolated to the whole map.
+func (pm *PersistMap[T]) ApproxMemoryBytes() int64 {
+	size := pm.values().Size()
+	if size == 0 {
+		return 0
+	}
+	var sampled, sampleBytes int64
+	pm.values().Range(func(key string, value interface{}) bool {
+		// Values failing to encode are counted with the overhead only
+		data, _ := pm.Store.encodeValue(value)
+		sampleBytes += int64(len(key) + len(data))
+		sampled++
+		return sampled < memorySampleSize
+	})
+	if sampled == 0 {
+		// Emptied concurrently
+		return 0
+	}
+	perEntry := sampleBytes/sampled + memoryEntryOverhead
+	if pm.times != nil {
+		perEntry += memoryTimeOverhead
+	}
+	return perEntry * int64(size)
+}
+
+// PendingCount returns the number of keys changed by Async methods that are not yet
+// written to the WAL, i.e. how far durability lags behind the in-memory state.
+func (pm *PersistMap[T]) PendingCount() int {
+	return pm.dirty.Size()
 }
 
 // Range calls f sequentially for each key and value present in the
@@ -532,9 +1862,23 @@ func (pm *PersistMap[T]) Size() int {
 // creation, modification and deletion. However, the concurrent
 // modification rule apply, i.e. the changes may be not reflected
 // in the subsequently iterated entries.
+//
+// With the default xsync.Map, no locks are held while f runs: entries of each
+// bucket are copied before f is called for them. So a slow f (e.g. doing network
+// I/O per entry) doesn't block writers, and there is no need to snapshot the map
+// before iterating. Implementations set by WithMapFactory are required to behave
+// the same, see ConcurrentMap.
+// Collect the entries into a slice first only if a consistent view is needed
+// for longer than a single entry.
 func (pm *PersistMap[T]) Range(f func(key string, value T) bool) {
-	pm.data.Range(func(key string, value interface{}) bool {
-		// Type assertion from interface{} to T
-		return f(key, value.(T))
+	pm.values().Range(func(key string, value interface{}) bool {
+		if _, lazy := value.(lazyValue); lazy {
+			typedValue, ok := pm.resolve(key)
+			if !ok {
+				return true
+			}
+			return f(key, typedValue)
+		}
+		return f(key, pm.typed(value))
 	})
 }
@@ -1,12 +1,22 @@
 package persist
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/puzpuzpuz/xsync/v3"
 )
 
 // TestPersistMap_SetGet tests basic Set/Get/Delete operations.
@@ -35,6 +45,10 @@ func TestPersistMap_SetGet(t *testing.T) {
 		t.Errorf("Expected 'bar', got %q", val)
 	}
 
+	if !pm.Has("foo") {
+		t.Errorf("Has returns false for existing key 'foo'")
+	}
+
 	// Delete the key.
 	if !pm.DeleteAsync("foo") {
 		t.Errorf("Expected key 'foo' to be deleted")
@@ -50,6 +64,9 @@ func TestPersistMap_SetGet(t *testing.T) {
 	if ok {
 		t.Errorf("Expected key 'foo' to be deleted, but it was found")
 	}
+	if pm.Has("foo") {
+		t.Errorf("Has returns true for deleted key 'foo'")
+	}
 }
 
 // TestPersistMap_Complex performs concurrent operations (Set/Delete) with multiple goroutines,
@@ -456,3 +473,2021 @@ func TestPersistMap_ComplexUpdateOperations(t *testing.T) {
 		}
 	}
 }
+
+// TestPersistMap_UpdateSkipIfUnchanged tests that no-op updates are not written to the WAL
+// when SkipIfUnchanged is requested.
+func TestPersistMap_UpdateSkipIfUnchanged(t *testing.T) {
+	store, _ := createTempStore(t)
+	pm, err := Map[int](store, "")
+	if err != nil {
+		t.Fatalf("Failed to create persist map: %v", err)
+	}
+
+	pm.Set("key", 1)
+	_, before := store.Stats()
+
+	pm.Update("key", func(upd *Update[int]) {
+		upd.SkipIfUnchanged()
+		upd.Value = 1
+	})
+	if _, after := store.Stats(); after != before {
+		t.Errorf("Expected no WAL records for unchanged value, got %d new", after-before)
+	}
+
+	pm.Update("key", func(upd *Update[int]) {
+		upd.SkipIfUnchanged()
+		upd.Value = 2
+	})
+	if _, after := store.Stats(); after != before+1 {
+		t.Errorf("Expected one WAL record for changed value, got %d new", after-before)
+	}
+	if val, _ := pm.Get("key"); val != 2 {
+		t.Errorf("Expected 2, got %d", val)
+	}
+}
+
+// TestPersistMap_LoadInvalidValue tests that Open fails when a record can't be decoded into the map's type.
+func TestPersistMap_LoadInvalidValue(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "persist_map_invalid_value_test_*.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tmpFile.Name()
+	defer os.Remove(path)
+
+	tmpFile.WriteString(WalHeader + "\n")
+	tmpFile.WriteString("S first:a\n1\n")
+	tmpFile.WriteString("S second:b\n\"not a number\"\n")
+	tmpFile.WriteString("S first:c\n3\n")
+	tmpFile.Close()
+
+	store := New()
+	if _, err := Map[int](store, "first"); err != nil {
+		t.Fatalf("Failed to create persist map 'first': %v", err)
+	}
+	if _, err := Map[int](store, "second"); err != nil {
+		t.Fatalf("Failed to create persist map 'second': %v", err)
+	}
+	err = store.Open(path)
+	if err == nil || !strings.Contains(err.Error(), "second:b") {
+		t.Fatalf("Expected error for key 'second:b', got: %v", err)
+	}
+}
+
+// TestPersistMap_LazyDecodeError tests that a lazy value failing to decode is reported
+// as missing without calling the ErrorHandler, and kept in the WAL as is
+func TestPersistMap_LazyDecodeError(t *testing.T) {
+	f := NewMemFile([]byte(WalHeader + "\nS m:a\n1\nS m:bad\n\"hello\"\n"))
+	store := New(WithLogger(log.New(io.Discard, "", 0)))
+	store.ErrorHandler = func(err error) {
+		t.Errorf("Unexpected store error: %v", err)
+	}
+	pm, _ := Map[int](store, "m", WithLazyDecode())
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	if v, ok := pm.Get("bad"); ok || v != 0 {
+		t.Errorf("Expected the undecodable key to be reported as missing, got %d, %v", v, ok)
+	}
+	if got := mapContents(pm); len(got) != 1 || got["a"] != 1 {
+		t.Errorf("Expected Range to skip the undecodable key, got %v", got)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	store.Close()
+	if !strings.Contains(string(f.Bytes()), "S m:bad\n\"hello\"\n") {
+		t.Errorf("Expected the raw value to be kept, got %q", f.Bytes())
+	}
+}
+
+// TestPersistMap_LazyDecode tests that lazily decoded values are readable, updatable
+// and survive Shrink without being accessed.
+func TestPersistMap_LazyDecode(t *testing.T) {
+	type record struct {
+		Name string
+		Tags []string
+	}
+	store, path := createTempStore(t)
+	pm, err := Map[record](store, "records")
+	if err != nil {
+		t.Fatalf("Failed to create persist map: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		pm.Set("key"+strconv.Itoa(i), record{Name: "name" + strconv.Itoa(i), Tags: []string{"a"}})
+	}
+
+	store2 := New()
+	lazy, err := Map[record](store2, "records", WithLazyDecode())
+	if err != nil {
+		t.Fatalf("Failed to create lazy persist map: %v", err)
+	}
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+
+	val, ok := lazy.Get("key1")
+	if !ok || val.Name != "name1" {
+		t.Fatalf("Expected name1 for key1, got %v (exists: %v)", val, ok)
+	}
+	newVal, _ := lazy.Update("key2", func(upd *Update[record]) {
+		upd.Value.Name += "!"
+	})
+	if newVal.Name != "name2!" {
+		t.Errorf("Expected name2! after update, got %q", newVal.Name)
+	}
+	count := 0
+	lazy.Range(func(key string, value record) bool {
+		if len(value.Tags) != 1 {
+			t.Errorf("Unexpected value for key %s: %v", key, value)
+		}
+		count++
+		return true
+	})
+	if count != 10 {
+		t.Errorf("Expected 10 items in Range, got %d", count)
+	}
+
+	// Values that were never accessed must be written back unchanged
+	if err := store2.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	store2.Close()
+
+	store3 := New()
+	pm3, _ := Map[record](store3, "records")
+	if err := store3.Open(path); err != nil {
+		t.Fatalf("Failed to reopen store after shrink: %v", err)
+	}
+	defer store3.Close()
+	if val, _ := pm3.Get("key9"); val.Name != "name9" {
+		t.Errorf("Expected name9 for key9 after shrink, got %q", val.Name)
+	}
+	if val, _ := pm3.Get("key2"); val.Name != "name2!" {
+		t.Errorf("Expected name2! for key2 after shrink, got %q", val.Name)
+	}
+}
+
+// TestPersistMap_ReopenAfterClose tests that map names can be registered again
+// on a new store for the same file, but not on a closed store.
+func TestPersistMap_ReopenAfterClose(t *testing.T) {
+	store, path := createTempStore(t)
+	pm, err := Map[int](store, "counters")
+	if err != nil {
+		t.Fatalf("Failed to create persist map: %v", err)
+	}
+	pm.Set("a", 1)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Store close failed: %v", err)
+	}
+
+	if _, err := Map[int](store, "counters"); err != ErrStoreClosed {
+		t.Errorf("Expected ErrStoreClosed for map on closed store, got: %v", err)
+	}
+
+	store2 := New()
+	pm2, err := Map[int](store2, "counters")
+	if err != nil {
+		t.Fatalf("Failed to register map on new store: %v", err)
+	}
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if val, ok := pm2.Get("a"); !ok || val != 1 {
+		t.Errorf("Expected 1 for key 'a', got %d (exists: %v)", val, ok)
+	}
+}
+
+// TestPersistMap_TypeMismatch tests that registering a map name again with a
+// different value type is reported with a descriptive error.
+func TestPersistMap_TypeMismatch(t *testing.T) {
+	store, _ := createTempStore(t)
+	defer store.Close()
+	if _, err := Map[int](store, "counters"); err != nil {
+		t.Fatalf("Failed to create persist map: %v", err)
+	}
+
+	if _, err := Map[int](store, "counters"); err != ErrMapAlreadyExists {
+		t.Errorf("Expected ErrMapAlreadyExists for the same type, got: %v", err)
+	}
+	_, err := Map[string](store, "counters")
+	if !errors.Is(err, ErrMapTypeMismatch) {
+		t.Fatalf("Expected ErrMapTypeMismatch for a different type, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "int") || !strings.Contains(err.Error(), "string") {
+		t.Errorf("Expected both types in the error message, got: %v", err)
+	}
+}
+
+// TestOpenSingleMapWithOptions tests that auto-shrink of OpenSingleMap can be
+// disabled or tuned.
+func TestOpenSingleMapWithOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "single.wal")
+
+	pm, err := OpenSingleMap[int](path)
+	if err != nil {
+		t.Fatalf("OpenSingleMap failed: %v", err)
+	}
+	if pm.Store.stopAutoShrink == nil {
+		t.Errorf("Expected auto-shrink to be started by default")
+	}
+	pm.Store.Close()
+
+	pm, err = OpenSingleMapWithOptions[int](path, WithAutoShrink(0, 0))
+	if err != nil {
+		t.Fatalf("OpenSingleMapWithOptions failed: %v", err)
+	}
+	if pm.Store.stopAutoShrink != nil {
+		t.Errorf("Expected auto-shrink to be disabled")
+	}
+	pm.Store.Close()
+
+	if _, err := OpenSingleMapWithOptions[int](path, WithAutoShrink(time.Minute, 0.5)); err == nil {
+		t.Errorf("Expected error for invalid shrink ratio")
+	}
+}
+
+// TestPersistMap_DeleteMany tests batch deletion and its persistence.
+func TestPersistMap_DeleteMany(t *testing.T) {
+	store, path := createTempStore(t)
+	pm, err := Map[int](store, "")
+	if err != nil {
+		t.Fatalf("Failed to create persist map: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		pm.Set("key"+strconv.Itoa(i), i)
+	}
+
+	deleted := pm.DeleteMany([]string{"key1", "key3", "key5", "missing"})
+	if deleted != 3 {
+		t.Errorf("Expected 3 deleted keys, got %d", deleted)
+	}
+	if pm.Size() != 7 {
+		t.Errorf("Expected 7 keys left, got %d", pm.Size())
+	}
+
+	pm2, err := OpenSingleMap[int](path)
+	if err != nil {
+		t.Fatalf("Failed to reopen map: %v", err)
+	}
+	defer pm2.Store.Close()
+	for i := 0; i < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		expected := i != 1 && i != 3 && i != 5
+		if pm2.Has(key) != expected {
+			t.Errorf("Reloaded: expected existence of %s to be %v", key, expected)
+		}
+	}
+}
+
+// benchmarkSetDurable measures fully durable writes either via SetFSync or via Set on a store opened with WithSyncOnWrite
+func benchmarkSetDurable(b *testing.B, syncOnWrite bool) {
+	tmpFile, err := os.CreateTemp("", "persist_bench_*.wal")
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(path)
+
+	store := New(WithSyncOnWrite(syncOnWrite))
+	pm, err := Map[int](store, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := store.Open(path); err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := "key" + strconv.Itoa(i%1000)
+		if syncOnWrite {
+			pm.Set(key, i)
+		} else if err := pm.SetFSync(key, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPersistMap_SetFSync(b *testing.B) {
+	benchmarkSetDurable(b, false)
+}
+
+func BenchmarkPersistMap_SetSyncOnWrite(b *testing.B) {
+	benchmarkSetDurable(b, true)
+}
+
+// BenchmarkPersistMap_IdleSync measures a background sync pass over 100 maps
+// without pending changes.
+func BenchmarkPersistMap_IdleSync(b *testing.B) {
+	store := New()
+	maps := make([]*PersistMap[int], 100)
+	for i := range maps {
+		maps[i], _ = Map[int](store, "map"+strconv.Itoa(i))
+	}
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		b.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pm := range maps {
+			pm.Sync()
+		}
+	}
+}
+
+// TestPersistMap_LoadFrom tests bulk loading from an iterator, including an error partway.
+func TestPersistMap_LoadFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "load.wal")
+	pm, err := OpenSingleMap[string](path)
+	if err != nil {
+		t.Fatalf("Failed to open map: %v", err)
+	}
+	// Large enough values to span several batches
+	value := strings.Repeat("x", 1000)
+	_, syncs := pm.Store.Latency()
+	n, err := pm.LoadFrom(func(yield func(string, string) bool) {
+		for i := 0; i < 3000; i++ {
+			if !yield("key"+strconv.Itoa(i), value) {
+				return
+			}
+		}
+	})
+	if err != nil || n != 3000 || pm.Size() != 3000 {
+		t.Fatalf("Expected 3000 loaded keys, got %d (size %d, err %v)", n, pm.Size(), err)
+	}
+	if _, after := pm.Store.Latency(); after.Count != syncs.Count+1 {
+		t.Errorf("Expected the final fsync to be tracked, got %d fsyncs", after.Count-syncs.Count)
+	}
+
+	n, err = pm.LoadFrom(func(yield func(string, string) bool) {
+		_ = yield("good", "1") && yield("bad\nkey", "2") && yield("never", "3")
+	})
+	if err == nil || n != 1 {
+		t.Errorf("Expected error after 1 loaded key, got %d (err %v)", n, err)
+	}
+	if !pm.Has("good") || pm.Has("never") {
+		t.Errorf("Expected keys before the error only")
+	}
+	pm.Store.Close()
+
+	pm, err = OpenSingleMap[string](path)
+	if err != nil {
+		t.Fatalf("Failed to reopen map: %v", err)
+	}
+	defer pm.Store.Close()
+	if val, ok := pm.Get("key2999"); pm.Size() != 3001 || !ok || val != value {
+		t.Errorf("Unexpected state after reopen: %d keys, key2999 exists: %v", pm.Size(), ok)
+	}
+}
+
+// benchmarkBulkLoad measures populating a map with 10k keys either with LoadFrom or a Set loop
+func benchmarkBulkLoad(b *testing.B, loadFrom bool) {
+	dir := b.TempDir()
+	value := strings.Repeat("x", 100)
+	seq := func(yield func(string, string) bool) {
+		for i := 0; i < 10000; i++ {
+			if !yield("key"+strconv.Itoa(i), value) {
+				return
+			}
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pm, err := OpenSingleMapWithOptions[string](filepath.Join(dir, strconv.Itoa(i)), WithAutoShrink(0, 0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if loadFrom {
+			if _, err := pm.LoadFrom(seq); err != nil {
+				b.Fatal(err)
+			}
+		} else {
+			for key, value := range seq {
+				pm.Set(key, value)
+			}
+			pm.Store.FSyncAll()
+		}
+		pm.Store.Close()
+	}
+}
+
+func BenchmarkPersistMap_LoadFrom(b *testing.B) {
+	benchmarkBulkLoad(b, true)
+}
+
+func BenchmarkPersistMap_SetLoop(b *testing.B) {
+	benchmarkBulkLoad(b, false)
+}
+
+// TestPersistMap_RetryFailedOpen tests that a failed Open discards partially loaded
+// records and the store can be opened again with the same maps.
+func TestPersistMap_RetryFailedOpen(t *testing.T) {
+	store := New()
+	pm, _ := Map[int](store, "m")
+	corrupted := WalHeader + "\nS m:a\n1\nS m:b\n2\nS orphan\n3\nX\n\nS m:d\n4\n"
+	if err := store.OpenFile(NewMemFile([]byte(corrupted))); err == nil {
+		t.Fatalf("Expected error for corrupted WAL")
+	}
+	if pm.Size() != 0 {
+		t.Errorf("Expected partially loaded records to be discarded, got %d", pm.Size())
+	}
+	if _, walRecords := store.Stats(); walRecords != 0 {
+		t.Errorf("Expected no WAL records counted after failed Open, got %d", walRecords)
+	}
+	if err := store.Close(); err != ErrNotLoaded {
+		t.Errorf("Expected ErrNotLoaded after failed Open, got: %v", err)
+	}
+
+	if err := store.OpenFile(NewMemFile([]byte(WalHeader + "\nS m:c\n3\n"))); err != nil {
+		t.Fatalf("Failed to retry Open: %v", err)
+	}
+	defer store.Close()
+	if pm.Size() != 1 || store.OrphanCount() != 0 {
+		t.Errorf("Expected only the retried WAL contents, got %d keys and %d orphans", pm.Size(), store.OrphanCount())
+	}
+	if val, ok := pm.Get("c"); !ok || val != 3 {
+		t.Errorf("Expected 3 for key 'c', got %d (exists: %v)", val, ok)
+	}
+}
+
+// TestPersistMap_Timestamps tests tracking of modification times with WithTimestamps,
+// including persistence across reopen and Shrink.
+func TestPersistMap_Timestamps(t *testing.T) {
+	mem := NewMemFile([]byte(WalHeader + "\nS m:old\n1\n"))
+	store := New()
+	pm, _ := Map[int](store, "m", WithTimestamps())
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	if _, meta, ok := pm.GetWithMeta("old"); !ok || !meta.Modified.IsZero() {
+		t.Errorf("Expected zero time for record without timestamp, got %v (exists: %v)", meta.Modified, ok)
+	}
+	start := time.Now()
+	pm.Set("a", 1)
+	pm.SetAsync("b", 2)
+	pm.Update("c", func(upd *Update[int]) { upd.Value = 3 })
+	pm.Set("gone", 4)
+	pm.Delete("gone")
+	metas := make(map[string]Meta)
+	for _, key := range []string{"a", "b", "c"} {
+		_, meta, ok := pm.GetWithMeta(key)
+		if !ok || meta.Modified.Before(start) || meta.Modified.After(time.Now()) {
+			t.Errorf("Unexpected modification time for key %q: %v (exists: %v)", key, meta.Modified, ok)
+		}
+		metas[key] = meta
+	}
+	if _, _, ok := pm.GetWithMeta("gone"); ok {
+		t.Errorf("Expected deleted key to be missing")
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	store.Close()
+
+	// Timestamps survive reopening
+	store2 := New()
+	pm2, _ := Map[int](store2, "m", WithTimestamps())
+	if err := store2.OpenFile(NewMemFile(mem.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	for key, want := range metas {
+		if _, meta, _ := pm2.GetWithMeta(key); !meta.Modified.Equal(want.Modified) {
+			t.Errorf("Expected time %v for key %q, got %v", want.Modified, key, meta.Modified)
+		}
+	}
+	if val, ok := pm2.Get("b"); !ok || val != 2 {
+		t.Errorf("Expected 2 for key 'b', got %d (exists: %v)", val, ok)
+	}
+
+	// Maps without the option still load timestamped records
+	store3 := New()
+	pm3, _ := Map[int](store3, "m")
+	if err := store3.OpenFile(NewMemFile(mem.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store without timestamps: %v", err)
+	}
+	defer store3.Close()
+	if val, meta, ok := pm3.GetWithMeta("a"); !ok || val != 1 || !meta.Modified.IsZero() {
+		t.Errorf("Expected 1 without time for key 'a', got %d, %v (exists: %v)", val, meta.Modified, ok)
+	}
+}
+
+// TestPersistMap_ChangedSince tests polling for keys changed after a timestamp.
+func TestPersistMap_ChangedSince(t *testing.T) {
+	store := New()
+	pm, _ := Map[int](store, "m", WithTimestamps())
+	plain, _ := Map[int](store, "plain")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	// Sleep between writes, so timestamps differ even with a coarse clock
+	pm.Set("a", 1)
+	time.Sleep(2 * time.Millisecond)
+	pm.Set("b", 2)
+	_, meta, _ := pm.GetWithMeta("b")
+	time.Sleep(2 * time.Millisecond)
+	pm.Set("c", 3)
+	pm.Set("a", 10)
+	pm.Delete("c")
+
+	changed := pm.ChangedSince(meta.Modified)
+	if strings.Join(changed, ",") != "a" {
+		t.Errorf("Expected [a] changed, got %q", changed)
+	}
+	if changed := pm.ChangedSince(time.Time{}); strings.Join(changed, ",") != "b,a" {
+		t.Errorf("Expected [b a] ordered by time, got %q", changed)
+	}
+	values := pm.GetMany([]string{"a", "b", "c"})
+	if len(values) != 2 || values["a"] != 10 || values["b"] != 2 {
+		t.Errorf("Unexpected GetMany result: %v", values)
+	}
+	if changed := plain.ChangedSince(time.Time{}); changed != nil {
+		t.Errorf("Expected nil without timestamps, got %q", changed)
+	}
+}
+
+// TestStore_MapNames tests listing of registered map namespaces.
+func TestStore_MapNames(t *testing.T) {
+	store := New()
+	Map[int](store, "users")
+	Map[string](store, "")
+	Map[bool](store, "flags")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	names := store.MapNames()
+	if strings.Join(names, ",") != ",flags,users" {
+		t.Errorf("Expected sorted names [ flags users], got %q", names)
+	}
+	store.Close()
+	if names := store.MapNames(); names != nil {
+		t.Errorf("Expected no names for closed store, got %q", names)
+	}
+}
+
+// TestPersistMap_DeleteWhere tests predicate-based batch deletion and its persistence.
+func TestPersistMap_DeleteWhere(t *testing.T) {
+	store := New()
+	pm, _ := Map[int](store, "m")
+	mem := NewMemFile(nil)
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		pm.Set("key"+strconv.Itoa(i), i)
+	}
+
+	deleted := pm.DeleteWhere(func(key string, value int) bool {
+		return value%2 == 0
+	})
+	if deleted != 5 || pm.Size() != 5 {
+		t.Errorf("Expected 5 deleted and 5 left, got %d deleted and %d left", deleted, pm.Size())
+	}
+	if deleted := pm.DeleteWhere(func(string, int) bool { return false }); deleted != 0 {
+		t.Errorf("Expected nothing deleted, got %d", deleted)
+	}
+	store.Close()
+
+	store2 := New()
+	pm2, _ := Map[int](store2, "m")
+	if err := store2.OpenFile(NewMemFile(mem.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	pm2.Range(func(key string, value int) bool {
+		if value%2 == 0 {
+			t.Errorf("Expected key %q to be deleted", key)
+		}
+		return true
+	})
+	if pm2.Size() != 5 {
+		t.Errorf("Expected 5 keys after reopen, got %d", pm2.Size())
+	}
+}
+
+// TestPersistMap_KeysWithColons tests that keys containing the namespace separator
+// are routed correctly on reload and can't be written into a map's namespace via Store.
+func TestPersistMap_KeysWithColons(t *testing.T) {
+	store := New()
+	pm, _ := Map[int](store, "foo")
+	if _, err := Map[int](store, "a:b"); err != ErrInvalidMapName {
+		t.Errorf("Expected ErrInvalidMapName for map name with colon, got: %v", err)
+	}
+	mem := NewMemFile(nil)
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	pm.Set("bar:baz", 1)
+	pm.Set(":", 2)
+	if err := store.Set("foo:bar:baz", 3); !errors.Is(err, ErrMapNamespace) {
+		t.Errorf("Expected ErrMapNamespace for key in map namespace, got: %v", err)
+	}
+	if err := store.Delete("foo:bar:baz"); !errors.Is(err, ErrMapNamespace) {
+		t.Errorf("Expected ErrMapNamespace for delete in map namespace, got: %v", err)
+	}
+	if err := store.Set("other:bar:baz", 4); err != nil {
+		t.Errorf("Failed to set orphan key with colons: %v", err)
+	}
+	store.Close()
+
+	store2 := New()
+	pm2, _ := Map[int](store2, "foo")
+	if err := store2.OpenFile(NewMemFile(mem.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if val, ok := pm2.Get("bar:baz"); !ok || val != 1 {
+		t.Errorf("Expected 1 for key 'bar:baz', got %d (exists: %v)", val, ok)
+	}
+	if val, ok := pm2.Get(":"); !ok || val != 2 {
+		t.Errorf("Expected 2 for key ':', got %d (exists: %v)", val, ok)
+	}
+	if pm2.Size() != 2 {
+		t.Errorf("Expected 2 keys in map, got %d", pm2.Size())
+	}
+	if val, err := Get[int](store2, "other:bar:baz"); err != nil || val != 4 {
+		t.Errorf("Expected orphan 4 for key 'other:bar:baz', got %d, %v", val, err)
+	}
+}
+
+// TestPersistMap_AttachMap tests adopting orphan records into a typed map after Open.
+func TestPersistMap_AttachMap(t *testing.T) {
+	store, _ := createTempStore(t)
+	store.Set("users:alice", 30)
+	store.Set("users:bob", 40)
+	store.Set("other", 1)
+
+	// Inspect generically first
+	if age, err := Get[int](store, "users:alice"); err != nil || age != 30 {
+		t.Fatalf("Expected 30 for users:alice, got %d, %v", age, err)
+	}
+
+	users, adopted, err := AttachMap[int](store, "users")
+	if err != nil {
+		t.Fatalf("Failed to attach map: %v", err)
+	}
+	if adopted != 2 {
+		t.Errorf("Expected 2 adopted records, got %d", adopted)
+	}
+	if age, _ := users.Get("bob"); age != 40 {
+		t.Errorf("Expected 40 for bob, got %d", age)
+	}
+	if store.OrphanCount() != 1 {
+		t.Errorf("Expected 1 orphan left, got %d", store.OrphanCount())
+	}
+}
+
+// TestPersistMap_MaxPending tests that Async methods sync immediately once the dirty cap is reached.
+func TestPersistMap_MaxPending(t *testing.T) {
+	store, _ := createTempStore(t)
+	store.SetSyncInterval(time.Hour)
+	pm, err := Map[int](store, "", WithMaxPending(10))
+	if err != nil {
+		t.Fatalf("Failed to create persist map: %v", err)
+	}
+	for i := 0; i < 9; i++ {
+		pm.SetAsync("key"+strconv.Itoa(i), i)
+	}
+	if pm.PendingCount() != 9 {
+		t.Fatalf("Expected 9 pending keys, got %d", pm.PendingCount())
+	}
+	pm.SetAsync("key9", 9)
+	if store.PendingCount() != 0 {
+		t.Fatalf("Expected pending keys to be synced at the cap, got %d", store.PendingCount())
+	}
+	if _, walRecords := store.Stats(); walRecords != 10 {
+		t.Fatalf("Expected 10 WAL records, got %d", walRecords)
+	}
+}
+
+// TestPersistMap_MixedAsyncAndSync tests interleavings of Async and immediate writes/deletes
+// on the same keys, verifying that the WAL always ends up with the latest in-memory state.
+func TestPersistMap_MixedAsyncAndSync(t *testing.T) {
+	store, path := createTempStore(t)
+	store.SetSyncInterval(time.Hour)
+	pm, err := Map[int](store, "")
+	if err != nil {
+		t.Fatalf("Failed to create persist map: %v", err)
+	}
+
+	// Sequential interleavings
+	pm.SetAsync("setAsync-set", 1)
+	pm.Set("setAsync-set", 2)
+	pm.SetAsync("setAsync-delete", 1)
+	pm.Delete("setAsync-delete")
+	pm.DeleteAsync("deleteAsync-set")
+	pm.Set("deleteAsync-set", 3)
+	pm.Set("set-deleteAsync", 4)
+	pm.DeleteAsync("set-deleteAsync")
+	pm.UpdateAsync("updateAsync-update", func(upd *Update[int]) { upd.Value = 5 })
+	pm.Update("updateAsync-update", func(upd *Update[int]) { upd.Value++ })
+	pm.Sync()
+
+	// Concurrent interleavings with background syncs
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				pm.Sync()
+			}
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := "concurrent" + strconv.Itoa(j%5)
+				switch (id + j) % 4 {
+				case 0:
+					pm.SetAsync(key, id*1000+j)
+				case 1:
+					pm.Set(key, id*1000+j)
+				case 2:
+					pm.DeleteAsync(key)
+				case 3:
+					pm.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	if err := store.FSyncAll(); err != nil {
+		t.Fatalf("FSyncAll failed: %v", err)
+	}
+
+	expected := make(map[string]int)
+	pm.Range(func(key string, value int) bool {
+		expected[key] = value
+		return true
+	})
+	if _, ok := expected["setAsync-delete"]; ok {
+		t.Errorf("Expected key 'setAsync-delete' to be deleted")
+	}
+	if expected["updateAsync-update"] != 6 {
+		t.Errorf("Expected 6 for 'updateAsync-update', got %d", expected["updateAsync-update"])
+	}
+
+	store2 := New()
+	pm2, _ := Map[int](store2, "")
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if pm2.Size() != len(expected) {
+		t.Errorf("Expected %d keys after reload, got %d", len(expected), pm2.Size())
+	}
+	for key, value := range expected {
+		if got, ok := pm2.Get(key); !ok || got != value {
+			t.Errorf("Reloaded value mismatch for key %s: expected %d, got %d (exists: %v)", key, value, got, ok)
+		}
+	}
+}
+
+// TestPersistValue tests the single value wrapper and its persistence.
+func TestPersistValue(t *testing.T) {
+	type Config struct {
+		Theme string
+		Port  int
+	}
+	path := filepath.Join(t.TempDir(), "config.db")
+	cfg, err := OpenValue[Config](path)
+	if err != nil {
+		t.Fatalf("Failed to open value: %v", err)
+	}
+	if cfg.Exists() || cfg.Get() != (Config{}) {
+		t.Errorf("Expected unset zero value, got %+v", cfg.Get())
+	}
+	cfg.Set(Config{Theme: "light", Port: 80})
+	updated := cfg.Update(func(c *Config) { c.Port = 8080 })
+	if updated != (Config{Theme: "light", Port: 8080}) {
+		t.Errorf("Unexpected value after Update: %+v", updated)
+	}
+	if _, err := cfg.UpdateFSync(func(c *Config) { c.Theme = "dark" }); err != nil {
+		t.Fatalf("UpdateFSync failed: %v", err)
+	}
+	cfg.Store.Close()
+
+	cfg2, err := OpenValue[Config](path, WithAutoShrink(0, 0))
+	if err != nil {
+		t.Fatalf("Failed to reopen value: %v", err)
+	}
+	defer cfg2.Store.Close()
+	if !cfg2.Exists() || cfg2.Get() != (Config{Theme: "dark", Port: 8080}) {
+		t.Errorf("Unexpected value after reopen: %+v", cfg2.Get())
+	}
+}
+
+// TestPersistMap_ShrinkDirtyKeys tests that Shrink neither loses changes of Async
+// methods made before or during it, nor leaves dirty keys to be written again after it
+func TestPersistMap_ShrinkDirtyKeys(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New(WithSyncInterval(0))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for i := range 100 {
+		pm.Set(strconv.Itoa(i), i)
+	}
+	for i := range 100 {
+		if i%10 == 0 {
+			pm.DeleteAsync(strconv.Itoa(i))
+		} else {
+			pm.SetAsync(strconv.Itoa(i), -i)
+		}
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	if n := pm.PendingCount(); n != 0 {
+		t.Errorf("Expected no dirty keys after Shrink, got %d", n)
+	}
+	if err := store.FSyncAll(); err != nil {
+		t.Fatalf("FSyncAll failed: %v", err)
+	}
+	if records := strings.Count(string(f.Bytes()), "\nS m:"); records != 90 {
+		t.Errorf("Expected 90 records without duplicates, got %d", records)
+	}
+
+	// Async changes racing with syncs and shrinks
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for _, task := range []func(){pm.Sync, func() { store.Shrink() }} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					task()
+				}
+			}
+		}()
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(rnd.Intn(100))
+		switch rnd.Intn(3) {
+		case 0:
+			pm.SetAsync(key, i)
+		case 1:
+			pm.DeleteAsync(key)
+		case 2:
+			pm.UpdateAsync(key, func(upd *Update[int]) { upd.Value++ })
+		}
+	}
+	close(stop)
+	wg.Wait()
+	expected := mapContents(pm)
+	store.Close()
+
+	store = New()
+	pm, _ = Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if got := mapContents(pm); !maps.Equal(got, expected) {
+		t.Errorf("Reopened map differs from memory: %d keys, expected %d", len(got), len(expected))
+	}
+}
+
+// TestPersistMap_ShrinkStress runs continuous writes, reads, background syncs and
+// shrinks concurrently, then checks that the reopened WAL matches the memory.
+// Runs for 30 seconds, or for 3 seconds with -short.
+func TestPersistMap_ShrinkStress(t *testing.T) {
+	duration := 30 * time.Second
+	if testing.Short() {
+		duration = 3 * time.Second
+	}
+
+	path := filepath.Join(t.TempDir(), "stress.wal")
+	store := New()
+	store.SetSyncInterval(10 * time.Millisecond)
+	store.ErrorHandler = func(err error) {
+		t.Errorf("Unexpected store error: %v", err)
+	}
+	pm, _ := Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	// Writers use disjoint key ranges with all kinds of write methods
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; time.Now().Before(deadline); i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(rnd.Intn(200))
+				switch rnd.Intn(5) {
+				case 0:
+					pm.Set(key, i)
+				case 1:
+					pm.SetAsync(key, i)
+				case 2:
+					pm.Update(key, func(upd *Update[int]) { upd.Value++ })
+				case 3:
+					pm.DeleteAsync(key)
+				case 4:
+					if err := pm.SetFSync(key, i); err != nil {
+						t.Errorf("SetFSync failed: %v", err)
+					}
+				}
+			}
+		}(w)
+	}
+	// Readers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			pm.Get("0-1")
+			pm.Range(func(key string, value int) bool { return true })
+		}
+	}()
+	// Shrinker
+	shrinks := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			if err := store.Shrink(); err != nil && err != ErrShrinkInProgress {
+				t.Errorf("Shrink failed: %v", err)
+			}
+			shrinks++
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	expected := make(map[string]int)
+	pm.Range(func(key string, value int) bool {
+		expected[key] = value
+		return true
+	})
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+	t.Logf("%d shrinks, %d keys", shrinks, len(expected))
+
+	store2 := New()
+	pm2, _ := Map[int](store2, "m")
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if pm2.Size() != len(expected) {
+		t.Errorf("Expected %d keys after reopen, got %d", len(expected), pm2.Size())
+	}
+	for key, want := range expected {
+		if got, ok := pm2.Get(key); !ok || got != want {
+			t.Errorf("Key %q: expected %d, got %d (exists: %v)", key, want, got, ok)
+		}
+	}
+}
+
+// customPoint uses a custom non-JSON encoding in the WAL
+type customPoint struct {
+	X, Y int
+}
+
+func (p customPoint) EncodePersist() ([]byte, error) {
+	return []byte(strconv.Itoa(p.X) + "," + strconv.Itoa(p.Y)), nil
+}
+
+func (p *customPoint) DecodePersist(data []byte) error {
+	x, y, ok := strings.Cut(string(data), ",")
+	if !ok {
+		return errors.New("invalid point")
+	}
+	var err error
+	if p.X, err = strconv.Atoi(x); err != nil {
+		return err
+	}
+	p.Y, err = strconv.Atoi(y)
+	return err
+}
+
+// TestPersistMap_CustomEncoding tests that values implementing Encoder/Decoder
+// are stored with their own encoding instead of JSON.
+func TestPersistMap_CustomEncoding(t *testing.T) {
+	mem := NewMemFile(nil)
+	store := New()
+	pm, _ := Map[customPoint](store, "points")
+	lazy, _ := Map[customPoint](store, "lazy", WithLazyDecode())
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	pm.Set("a", customPoint{1, 2})
+	pm.SetAsync("b", customPoint{3, 4})
+	lazy.Set("c", customPoint{5, 6})
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	store.Close()
+	if !strings.Contains(string(mem.Bytes()), "S points:a\n1,2\n") {
+		t.Errorf("Expected custom encoding in WAL, got %q", mem.Bytes())
+	}
+
+	store2 := New()
+	pm2, _ := Map[customPoint](store2, "points")
+	lazy2, _ := Map[customPoint](store2, "lazy", WithLazyDecode())
+	if err := store2.OpenFile(NewMemFile(mem.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if p, _ := pm2.Get("b"); p != (customPoint{3, 4}) {
+		t.Errorf("Expected {3 4} for key 'b', got %v", p)
+	}
+	if p, _ := lazy2.Get("c"); p != (customPoint{5, 6}) {
+		t.Errorf("Expected {5 6} for lazy key 'c', got %v", p)
+	}
+
+	// DumpJSON embeds the custom encoding as strings
+	var buf strings.Builder
+	if err := store2.DumpJSON(&buf); err != nil {
+		t.Fatalf("DumpJSON failed: %v", err)
+	}
+	var dump map[string]string
+	if err := json.Unmarshal([]byte(buf.String()), &dump); err != nil {
+		t.Fatalf("Dump is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if dump["points:a"] != "1,2" || dump["lazy:c"] != "5,6" {
+		t.Errorf("Unexpected dump contents: %v", dump)
+	}
+}
+
+// TestPersistMap_ReadThrough tests fetching missing keys from a backing source.
+func TestPersistMap_ReadThrough(t *testing.T) {
+	source := map[string]int{"a": 1, "b": 2}
+	calls := 0
+	fetch := func(key string) (int, bool) {
+		calls++
+		value, ok := source[key]
+		return value, ok
+	}
+
+	for _, persist := range []bool{false, true} {
+		calls = 0
+		mem := NewMemFile(nil)
+		store := New()
+		opts := []MapOption{WithReadThrough(fetch)}
+		if persist {
+			opts = append(opts, WithReadThroughPersist())
+		}
+		pm, err := Map[int](store, "m", opts...)
+		if err != nil {
+			t.Fatalf("Failed to create map: %v", err)
+		}
+		if err := store.OpenFile(mem); err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+
+		if val, ok := pm.Get("a"); !ok || val != 1 {
+			t.Errorf("Expected fetched value 1, got %d (exists: %v)", val, ok)
+		}
+		pm.Get("a")
+		if _, ok := pm.Get("missing"); ok {
+			t.Errorf("Expected missing key to stay missing")
+		}
+		if calls != 2 {
+			t.Errorf("Expected 2 fetches, got %d", calls)
+		}
+		if !pm.Has("a") || pm.Has("b") {
+			t.Errorf("Expected only the fetched key to be cached")
+		}
+		if pm.PendingCount() != map[bool]int{false: 0, true: 1}[persist] {
+			t.Errorf("Unexpected pending count %d (persist: %v)", pm.PendingCount(), persist)
+		}
+		store.Close()
+
+		store = New()
+		pm, _ = Map[int](store, "m")
+		if err := store.OpenFile(mem); err != nil {
+			t.Fatalf("Failed to reopen store: %v", err)
+		}
+		if pm.Has("a") != persist {
+			t.Errorf("Expected fetched key persisted: %v", persist)
+		}
+		store.Close()
+	}
+
+	if _, err := Map[string](New(), "m", WithReadThrough(fetch)); err == nil {
+		t.Errorf("Expected error for mismatched read-through function type")
+	}
+}
+
+// TestPersistMap_Pop tests that concurrent Pops hand out every value exactly once.
+func TestPersistMap_Pop(t *testing.T) {
+	mem := NewMemFile(nil)
+	store := New()
+	pm, _ := Map[int](store, "jobs")
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		pm.Set("job"+strconv.Itoa(i), i)
+	}
+	if _, ok := pm.Pop("missing"); ok {
+		t.Errorf("Expected Pop of missing key to fail")
+	}
+
+	var mu sync.Mutex
+	popped := make(map[int]int)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if val, ok := pm.Pop("job" + strconv.Itoa(i)); ok {
+					mu.Lock()
+					popped[val]++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(popped) != 100 || pm.Size() != 0 {
+		t.Errorf("Expected all 100 jobs popped, got %d (left %d)", len(popped), pm.Size())
+	}
+	for val, n := range popped {
+		if n != 1 {
+			t.Errorf("Job %d popped %d times", val, n)
+		}
+	}
+	store.Close()
+	if n := strings.Count(string(mem.Bytes()), "\nD "); n != 100 {
+		t.Errorf("Expected 100 delete records, got %d", n)
+	}
+}
+
+// TestPersistMap_ApproxMemoryBytes tests that the estimate grows with the data.
+func TestPersistMap_ApproxMemoryBytes(t *testing.T) {
+	store := New()
+	pm, _ := Map[string](store, "m")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	if n := pm.ApproxMemoryBytes(); n != 0 {
+		t.Errorf("Expected 0 for empty map, got %d", n)
+	}
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 5000; i++ {
+		pm.SetAsync("key"+strconv.Itoa(i), value)
+	}
+	// The sample covers only a part of the map, but all values are the same
+	if n := pm.ApproxMemoryBytes(); n < 5000*1000 || n > 5000*1200 {
+		t.Errorf("Unexpected estimate for 5MB of values: %d", n)
+	}
+
+	// The map emptied between Size and Range
+	store = New(WithMapFactory(func(sizeHint int) ConcurrentMap {
+		return clearedOnSizeMap{newXsyncMap(sizeHint)}
+	}))
+	pm, _ = Map[string](store, "m")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	pm.Set("a", value)
+	if n := pm.ApproxMemoryBytes(); n != 0 {
+		t.Errorf("Expected 0 for map emptied concurrently, got %d", n)
+	}
+}
+
+// clearedOnSizeMap is a ConcurrentMap emptied right after Size, like by a concurrent Delete
+type clearedOnSizeMap struct {
+	ConcurrentMap
+}
+
+func (m clearedOnSizeMap) Size() int {
+	size := m.ConcurrentMap.Size()
+	m.Clear()
+	return size
+}
+
+// TestPersistMap_RangeDoesNotBlockWriters tests that writes to the map, including the
+// key being visited, don't wait for a slow Range callback.
+func TestPersistMap_RangeDoesNotBlockWriters(t *testing.T) {
+	store := New()
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		pm.Set("key"+strconv.Itoa(i), i)
+	}
+
+	pm.Range(func(key string, value int) bool {
+		done := make(chan struct{})
+		go func() {
+			pm.Set(key, value+1000)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Write to key %q blocked by Range", key)
+		}
+		return true
+	})
+	if val, _ := pm.Get("key42"); val != 1042 {
+		t.Errorf("Expected updated value 1042, got %d", val)
+	}
+}
+
+// TestPersistMap_Rename tests moving values between keys and its WAL records.
+func TestPersistMap_Rename(t *testing.T) {
+	mem := NewMemFile(nil)
+	store := New()
+	pm, _ := Map[[]int](store, "m")
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	pm.Set("alice", []int{1, 2})
+	pm.Set("bob", []int{3})
+
+	if pm.Rename("missing", "alice") {
+		t.Errorf("Expected Rename of missing key to fail")
+	}
+	if !pm.Rename("alice", "alicia") {
+		t.Errorf("Expected Rename to succeed")
+	}
+	if !pm.Rename("alicia", "bob") {
+		t.Errorf("Expected Rename over existing key to succeed")
+	}
+	if pm.Has("alice") || pm.Has("alicia") || pm.Size() != 1 {
+		t.Errorf("Expected only the renamed key, got %d keys", pm.Size())
+	}
+	if val, _ := pm.Get("bob"); len(val) != 2 || val[1] != 2 {
+		t.Errorf("Unexpected value after rename: %v", val)
+	}
+	if !strings.Contains(string(mem.Bytes()), "S m:alicia\n[1,2]\nD m:alice\n\n") {
+		t.Errorf("Expected set and delete records written together, got %q", mem.Bytes())
+	}
+	store.Close()
+
+	store = New()
+	pm, _ = Map[[]int](store, "m")
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if val, ok := pm.Get("bob"); !ok || len(val) != 2 || pm.Size() != 1 {
+		t.Errorf("Unexpected state after reopen: %v, %d keys", val, pm.Size())
+	}
+}
+
+// TestShardedMap tests routing of keys across shards and persistence of all of them.
+func TestShardedMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sharded.wal")
+	sm, err := OpenShardedMap[int](path, 4)
+	if err != nil {
+		t.Fatalf("Failed to open sharded map: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		sm.Set("key"+strconv.Itoa(i), i)
+	}
+	sm.Delete("key0")
+	sm.Update("key1", func(upd *Update[int]) { upd.Value = 100 })
+	for i, pm := range sm.Shards() {
+		if pm.Size() == 0 {
+			t.Errorf("Expected keys in shard %d", i)
+		}
+	}
+	if err := sm.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	if err := sm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	sm, err = OpenShardedMap[int](path, 4)
+	if err != nil {
+		t.Fatalf("Failed to reopen sharded map: %v", err)
+	}
+	defer sm.Close()
+	if sm.Size() != 99 || sm.Has("key0") {
+		t.Errorf("Expected 99 keys without key0, got %d", sm.Size())
+	}
+	if val, ok := sm.Get("key1"); !ok || val != 100 {
+		t.Errorf("Expected 100 for key1, got %d (exists: %v)", val, ok)
+	}
+	sum := 0
+	sm.Range(func(key string, value int) bool {
+		sum += value
+		return true
+	})
+	if sum != 4950-0-1+100 {
+		t.Errorf("Unexpected sum of values: %d", sum)
+	}
+
+	if _, err := OpenShardedMap[int](path, 0); err == nil {
+		t.Errorf("Expected error for zero shards")
+	}
+
+	// The shard count is recorded in the files, along with metadata of the options
+	if got := sm.Shards()[2].Store.Metadata(); got["shard"] != "2" || got["shards"] != "4" {
+		t.Errorf("Unexpected metadata of shard 2: %v", got)
+	}
+	if _, err := OpenShardedMap[int](path, 2); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Expected ErrShardCount for a different number of shards, got %v", err)
+	}
+	other := filepath.Join(t.TempDir(), "other.wal")
+	sm2, err := OpenShardedMap[int](other, 2, WithMetadata(map[string]string{"app": "test"}))
+	if err != nil {
+		t.Fatalf("Failed to open sharded map: %v", err)
+	}
+	if got := sm2.Shards()[1].Store.Metadata(); got["app"] != "test" || got["shard"] != "1" {
+		t.Errorf("Expected metadata of the options to be kept, got %v", got)
+	}
+	sm2.Close()
+	// Swapped files are shards of the same map, but not in their places
+	os.Rename(other+".0", other+".tmp")
+	os.Rename(other+".1", other+".0")
+	os.Rename(other+".tmp", other+".1")
+	if _, err := OpenShardedMap[int](other, 2); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Expected ErrShardCount for swapped files, got %v", err)
+	}
+}
+
+// benchmarkShardedLoad measures loading of 200k keys spread across the given number of shards
+func benchmarkShardedLoad(b *testing.B, shards int) {
+	path := filepath.Join(b.TempDir(), "load.wal")
+	sm, err := OpenShardedMap[string](path, shards, WithAutoShrink(0, 0))
+	if err != nil {
+		b.Fatalf("Failed to open sharded map: %v", err)
+	}
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 200000; i++ {
+		sm.SetAsync("key"+strconv.Itoa(i), value)
+	}
+	sm.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm, err := OpenShardedMap[string](path, shards, WithAutoShrink(0, 0))
+		if err != nil {
+			b.Fatalf("Failed to reopen sharded map: %v", err)
+		}
+		b.StopTimer()
+		sm.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkShardedMap_Load1(b *testing.B) {
+	benchmarkShardedLoad(b, 1)
+}
+
+func BenchmarkShardedMap_Load4(b *testing.B) {
+	benchmarkShardedLoad(b, 4)
+}
+
+// TestPersistMap_NilValues tests that keys holding nil pointers or nil interfaces exist
+// distinctly from deleted keys across Shrink and reopening.
+func TestPersistMap_NilValues(t *testing.T) {
+	type node struct{ Next *node }
+	mem := NewMemFile(nil)
+	open := func() (*Store, *PersistMap[*node], *PersistMap[any], *PersistMap[*node]) {
+		store := New()
+		ptrs, _ := Map[*node](store, "ptrs")
+		anys, _ := Map[any](store, "anys")
+		lazy, _ := Map[*node](store, "lazy", WithLazyDecode())
+		if err := store.OpenFile(mem); err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		return store, ptrs, anys, lazy
+	}
+	check := func(stage string, ptrs *PersistMap[*node], anys *PersistMap[any], lazy *PersistMap[*node]) {
+		for _, key := range []string{"set", "async", "updated", "renamed"} {
+			if val, ok := ptrs.Get(key); !ok || val != nil {
+				t.Errorf("%s: expected nil pointer for %q, got %v (exists: %v)", stage, key, val, ok)
+			}
+		}
+		if val, ok := anys.Get("set"); !ok || val != nil {
+			t.Errorf("%s: expected nil interface, got %v (exists: %v)", stage, val, ok)
+		}
+		if val, ok := lazy.Get("set"); !ok || val != nil {
+			t.Errorf("%s: expected nil pointer in lazy map, got %v (exists: %v)", stage, val, ok)
+		}
+		if ptrs.Has("deleted") || ptrs.Has("old") || ptrs.Size() != 5 {
+			t.Errorf("%s: expected deleted keys to be missing, got %d keys", stage, ptrs.Size())
+		}
+		nils := 0
+		ptrs.Range(func(key string, value *node) bool {
+			if value == nil {
+				nils++
+			}
+			return true
+		})
+		if nils != 4 {
+			t.Errorf("%s: expected 4 nil values in Range, got %d", stage, nils)
+		}
+	}
+
+	store, ptrs, anys, lazy := open()
+	ptrs.Set("set", nil)
+	ptrs.SetAsync("async", nil)
+	ptrs.Set("updated", &node{})
+	ptrs.Update("updated", func(upd *Update[*node]) { upd.Value = nil })
+	ptrs.Set("old", nil)
+	ptrs.Rename("old", "renamed")
+	ptrs.Set("deleted", nil)
+	ptrs.Delete("deleted")
+	ptrs.Set("value", &node{Next: &node{}})
+	anys.Set("set", nil)
+	lazy.Set("set", nil)
+	check("in memory", ptrs, anys, lazy)
+	store.Close()
+
+	store, ptrs, anys, lazy = open()
+	check("after reopen", ptrs, anys, lazy)
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	store.Close()
+
+	store, ptrs, anys, lazy = open()
+	defer store.Close()
+	check("after shrink", ptrs, anys, lazy)
+	if val, _ := ptrs.Get("value"); val == nil || val.Next == nil {
+		t.Errorf("Expected non-nil value to survive, got %v", val)
+	}
+
+	// Orphans behave the same way
+	store.Set("orphan", nil)
+	for i := 0; i < 2; i++ {
+		if val, err := Get[any](store, "orphan"); err != nil || val != nil {
+			t.Errorf("Expected nil orphan, got %v, %v", val, err)
+		}
+	}
+}
+
+// TestPersistMap_FSyncErrors tests that FSync methods return write errors instead of
+// passing them to the ErrorHandler
+func TestPersistMap_FSyncErrors(t *testing.T) {
+	store, path := createTempStore(t)
+	pm, err := Map[int](store, "m")
+	if err != nil {
+		t.Fatalf("failed to create map: %v", err)
+	}
+	if err := pm.SetFSync("a", 1); err != nil {
+		t.Fatalf("SetFSync failed: %v", err)
+	}
+	if _, _, err := pm.UpdateFSync("a", func(upd *Update[int]) { upd.Value++ }); err != nil {
+		t.Fatalf("UpdateFSync failed: %v", err)
+	}
+	if err := pm.DeleteFSync("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got: %v", err)
+	}
+
+	// Write errors are returned to the caller instead of the ErrorHandler
+	handled := 0
+	store.ErrorHandler = func(error) { handled++ }
+	if err := store.Quiesce(); err != nil {
+		t.Fatalf("failed to quiesce store: %v", err)
+	}
+	if err := pm.SetFSync("b", 2); !errors.Is(err, ErrQuiesced) {
+		t.Fatalf("expected ErrQuiesced from SetFSync, got: %v", err)
+	}
+	if _, _, err := pm.UpdateFSync("a", func(upd *Update[int]) { upd.Delete() }); !errors.Is(err, ErrQuiesced) {
+		t.Fatalf("expected ErrQuiesced from UpdateFSync, got: %v", err)
+	}
+	if handled != 0 {
+		t.Fatalf("expected no calls to ErrorHandler, got %d", handled)
+	}
+	pm.Set("c", 3)
+	if handled != 1 {
+		t.Fatalf("expected Set to report the error to ErrorHandler, got %d calls", handled)
+	}
+	store.Resume()
+	store.Close()
+
+	store2 := New()
+	pm2, _ := Map[int](store2, "m")
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if val, _ := pm2.Get("a"); val != 2 {
+		t.Fatalf("expected a=2 after reopen, got %d", val)
+	}
+}
+
+// TestPersistMap_InitialCapacity tests that the map is presized for the capacity hint,
+// also when loading fewer records
+func TestPersistMap_InitialCapacity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cap.db")
+	pm, err := OpenSingleMapWithOptions[int](path, WithSingleMapOptions(WithInitialCapacity(10000)))
+	if err != nil {
+		t.Fatalf("failed to open map: %v", err)
+	}
+	if c := pm.values().(*xsync.Map).Stats().Capacity; c < 10000 {
+		t.Fatalf("expected capacity of at least 10000, got %d", c)
+	}
+	for i := range 100 {
+		pm.Set(strconv.Itoa(i), i)
+	}
+	pm.Store.Close()
+
+	// Loading presizes for the records in the WAL, but not below the hint
+	pm, err = OpenSingleMapWithOptions[int](path, WithSingleMapOptions(WithInitialCapacity(10000)))
+	if err != nil {
+		t.Fatalf("failed to reopen map: %v", err)
+	}
+	defer pm.Store.Close()
+	if c := pm.values().(*xsync.Map).Stats().Capacity; c < 10000 {
+		t.Fatalf("expected capacity of at least 10000 after load, got %d", c)
+	}
+	if pm.Size() != 100 {
+		t.Fatalf("expected 100 keys, got %d", pm.Size())
+	}
+}
+
+// TestPersistMap_RangeUpdate tests the actions of RangeUpdate and that keys failing to
+// encode are kept
+func TestPersistMap_RangeUpdate(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New()
+	pm, _ := Map[any](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	for i := range 100 {
+		pm.Set(strconv.Itoa(i), i)
+	}
+	_, before := store.Stats()
+
+	updated, err := pm.RangeUpdate(func(key string, upd *Update[any]) {
+		n := upd.Value.(int)
+		switch {
+		case n == 0:
+			upd.Cancel()
+		case n == 1:
+			upd.Set(make(chan int)) // fails to encode
+		case n%2 == 1:
+			upd.Delete()
+		default:
+			upd.Value = n * 10
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "`1`") {
+		t.Fatalf("expected an encoding error for key 1, got: %v", err)
+	}
+	if updated != 98 {
+		t.Fatalf("expected 98 updated keys, got %d", updated)
+	}
+	if _, after := store.Stats(); after != before+98 {
+		t.Fatalf("expected 98 new WAL records, got %d", after-before)
+	}
+	store.Close()
+
+	store = New()
+	pm, _ = Map[any](store, "m")
+	if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if pm.Size() != 51 {
+		t.Fatalf("expected 51 keys, got %d", pm.Size())
+	}
+	for key, want := range map[string]any{"0": 0.0, "1": 1.0, "2": 20.0, "98": 980.0} {
+		if v, _ := pm.Get(key); v != want {
+			t.Errorf("key %s: expected %v, got %v", key, want, v)
+		}
+	}
+	if pm.Has("3") {
+		t.Error("expected key 3 to be deleted")
+	}
+}
+
+// TestPersistMap_GetRaw tests that GetRaw returns values as stored in the WAL, keeping
+// lazy values undecoded.
+func TestPersistMap_GetRaw(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	wal := WalHeader + "\nS lazy:a\n{\"X\": 1,  \"Y\": 2}\n"
+	store := New()
+	pm, _ := Map[point](store, "m")
+	lazy, _ := Map[point](store, "lazy", WithLazyDecode())
+	if err := store.OpenFile(NewMemFile([]byte(wal))); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	pm.Set("a", point{3, 4})
+	if raw, ok := pm.GetRaw("a"); !ok || string(raw) != `{"X":3,"Y":4}` {
+		t.Errorf("expected the encoded value, got %q, %v", raw, ok)
+	}
+	if raw, ok := pm.GetRaw("missing"); ok || raw != nil {
+		t.Errorf("expected no value for a missing key, got %q", raw)
+	}
+
+	// Returned as stored, with the original formatting
+	if raw, ok := lazy.GetRaw("a"); !ok || string(raw) != `{"X": 1,  "Y": 2}` {
+		t.Errorf("expected the stored value, got %q, %v", raw, ok)
+	}
+	if v, _ := lazy.values().Load("a"); v != lazyValue(`{"X": 1,  "Y": 2}`) {
+		t.Errorf("expected the value to stay undecoded, got %#v", v)
+	}
+	lazy.Get("a")
+	if raw, _ := lazy.GetRaw("a"); string(raw) != `{"X":1,"Y":2}` {
+		t.Errorf("expected the re-encoded value after decoding, got %q", raw)
+	}
+}
+
+// TestPersistMap_UpdateIf tests that UpdateIf writes only when the condition holds.
+func TestPersistMap_UpdateIf(t *testing.T) {
+	store := New()
+	pm, _ := Map[string](store, "jobs")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	pm.Set("a", "queued")
+
+	isQueued := func(state string, exists bool) bool { return exists && state == "queued" }
+	start := func(upd *Update[string]) { upd.Value = "running" }
+	_, before := store.Stats()
+	if !pm.UpdateIf("a", isQueued, start) {
+		t.Fatal("expected the update to be applied")
+	}
+	if pm.UpdateIf("a", isQueued, start) || pm.UpdateIf("missing", isQueued, start) {
+		t.Fatal("expected the update to be skipped")
+	}
+	if pm.UpdateIf("a", func(string, bool) bool { return true }, func(upd *Update[string]) { upd.Cancel() }) {
+		t.Fatal("expected a cancelled update not to be applied")
+	}
+	if pm.UpdateIf("a", func(string, bool) bool { return true }, func(upd *Update[string]) { upd.SkipIfUnchanged() }) {
+		t.Fatal("expected a skipped update not to be applied")
+	}
+	if _, after := store.Stats(); after != before+1 {
+		t.Errorf("expected 1 WAL record, got %d", after-before)
+	}
+	if v, _ := pm.Get("a"); v != "running" || pm.Has("missing") {
+		t.Errorf("unexpected contents: %v", mapContents(pm))
+	}
+
+	// A failed write is reported, not applied
+	f := newFaultyFile(nil)
+	var handled atomic.Int32
+	store = New(WithErrorHandler(func(error) { handled.Add(1) }))
+	pm, _ = Map[string](store, "jobs")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	f.writeLimit.Store(int64(len(f.Bytes())))
+	if pm.UpdateIf("a", func(string, bool) bool { return true }, func(upd *Update[string]) { upd.Value = "x" }) {
+		t.Error("expected a failed write not to be applied")
+	}
+	if handled.Load() != 1 {
+		t.Errorf("expected the write error to be reported once, got %d", handled.Load())
+	}
+}
+
+// TestPersistMap_SetIfAbsent tests that an existing key is kept and that exactly one of
+// concurrent claims wins
+func TestPersistMap_SetIfAbsent(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New()
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	if !pm.SetIfAbsent("a", 1) {
+		t.Fatal("expected an absent key to be stored")
+	}
+	if pm.SetIfAbsent("a", 2) {
+		t.Fatal("expected an existing key to be kept")
+	}
+	if v, _ := pm.Get("a"); v != 1 {
+		t.Errorf("expected 1, got %d", v)
+	}
+	if got := string(f.Bytes()); strings.Count(got, "S m:a\n") != 1 {
+		t.Errorf("expected a single record, got %q", got)
+	}
+
+	// Exactly one of concurrent claims of a key wins
+	var wg sync.WaitGroup
+	var wins atomic.Int32
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if pm.SetIfAbsent("slot", i) {
+				wins.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if wins.Load() != 1 {
+		t.Errorf("expected exactly one claim to win, got %d", wins.Load())
+	}
+}
+
+// TestPersistMap_WriteCoalescing tests that repeated writes of a key are held in memory
+// until the next sync, except for FSync methods
+func TestPersistMap_WriteCoalescing(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New(WithSyncInterval(0))
+	pm, _ := Map[int](store, "m", WithWriteCoalescing(time.Hour))
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	records := func() int { return strings.Count(string(f.Bytes()), "\n") / 2 }
+
+	for i := 1; i <= 100; i++ {
+		pm.Set("counter", i)
+		pm.Update("other", func(upd *Update[int]) { upd.Value++ })
+	}
+	if n := records(); n != 2 {
+		t.Errorf("Expected only the first writes of keys in the WAL, got %d records", n)
+	}
+	if v, _ := pm.Get("counter"); v != 100 {
+		t.Errorf("Expected memory to hold the latest value, got %d", v)
+	}
+	if err := store.FSyncAll(); err != nil {
+		t.Fatalf("FSyncAll failed: %v", err)
+	}
+	if n := records(); n != 4 {
+		t.Errorf("Expected the latest values to be flushed, got %d records", n)
+	}
+
+	// FSync methods are not coalesced
+	if err := pm.SetFSync("counter", 101); err != nil || records() != 5 {
+		t.Errorf("Expected SetFSync to write immediately, got %d records, %v", records(), err)
+	}
+	pm.Delete("other")
+	if !strings.HasSuffix(string(f.Bytes()), "101\n") {
+		t.Errorf("Expected Delete to be coalesced, got %q", f.Bytes())
+	}
+	store.Close()
+
+	store = New()
+	pm, _ = Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if got := mapContents(pm); len(got) != 1 || got["counter"] != 101 {
+		t.Errorf("Unexpected contents after reopen: %v", got)
+	}
+}
+
+// TestPersistMap_SyncKey tests writing and fsyncing a single dirty key
+func TestPersistMap_SyncKey(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New(WithSyncInterval(0))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	pm.SetAsync("payment", 100)
+	pm.SetAsync("other", 1)
+	if err := pm.SyncKey("payment"); err != nil {
+		t.Fatalf("SyncKey failed: %v", err)
+	}
+	if got := string(f.Bytes()); got != WalHeader+"\nS m:payment\n100\n" {
+		t.Errorf("Expected only the synced key in the WAL, got %q", got)
+	}
+	if _, sync := store.Latency(); sync.Count != 1 {
+		t.Errorf("Expected one fsync, got %d", sync.Count)
+	}
+	if n := pm.PendingCount(); n != 1 {
+		t.Errorf("Expected the other key to stay dirty, got %d pending", n)
+	}
+
+	// A clean key is only fsynced, a deleted one is written as a delete
+	if err := pm.SyncKey("payment"); err != nil || strings.Count(string(f.Bytes()), "payment") != 1 {
+		t.Errorf("Expected a clean key not to be written again, got %q, %v", f.Bytes(), err)
+	}
+	pm.DeleteAsync("payment")
+	if err := pm.SyncKey("payment"); err != nil || !strings.HasSuffix(string(f.Bytes()), "D m:payment\n\n") {
+		t.Errorf("Expected a delete record, got %q, %v", f.Bytes(), err)
+	}
+}
+
+// TestPersistMap_EmptyKeys tests empty keys and the map with the empty name
+func TestPersistMap_EmptyKeys(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New()
+	named, _ := Map[string](store, "first")
+	unnamed, _ := Map[string](store, "")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	named.Set("", "a")
+	unnamed.Set("", "b")
+	unnamed.Set("x", "c")
+	if err := store.Set("", "d"); err == nil {
+		t.Error("Expected an error for an empty full key")
+	}
+	if err := store.WriteMarker("", nil); err == nil {
+		t.Error("Expected an error for an empty marker name")
+	}
+	store.Close()
+	if got := string(f.Bytes()); got != WalHeader+"\nS first:\n\"a\"\nS :\n\"b\"\nS :x\n\"c\"\n" {
+		t.Errorf("Unexpected WAL: %q", got)
+	}
+
+	// Full keys without a colon belong to the map with the empty name
+	f = NewMemFile(append(f.Bytes(), "S y\n\"e\"\n"...))
+	store = New()
+	named, _ = Map[string](store, "first")
+	unnamed, _ = Map[string](store, "")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if v, ok := named.Get(""); !ok || v != "a" {
+		t.Errorf("Expected the empty key of a named map, got %q, %v", v, ok)
+	}
+	if got := mapContents(unnamed); len(got) != 3 || got[""] != "b" || got["x"] != "c" || got["y"] != "e" {
+		t.Errorf("Unexpected contents of the unnamed map: %v", got)
+	}
+}
+
+// TestPersistMap_ReplaceAll tests atomic replacement of the map contents
+func TestPersistMap_ReplaceAll(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New(WithSyncInterval(0))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	pm.Set("a", 1)
+	pm.Set("b", 2)
+	pm.Set("d", 4)
+	pm.DeleteAsync("d")
+	pm.SetAsync("c", 3)
+
+	if err := pm.ReplaceAll(map[string]int{"b": 20, "bad\nkey": 0}); err == nil {
+		t.Error("Expected an error for an invalid key")
+	}
+	if pm.Size() != 3 || pm.PendingCount() != 2 {
+		t.Errorf("Expected the map to stay unchanged after a failed replace, got %d keys", pm.Size())
+	}
+	if err := pm.ReplaceAll(map[string]int{"b": 20, "e": 5}); err != nil {
+		t.Fatalf("ReplaceAll failed: %v", err)
+	}
+	if _, sync := store.Latency(); sync.Count != 1 {
+		t.Errorf("Expected one fsync, got %d", sync.Count)
+	}
+	want := map[string]int{"b": 20, "e": 5}
+	check := func(pm *PersistMap[int]) {
+		t.Helper()
+		got := map[string]int{}
+		pm.Range(func(key string, value int) bool {
+			got[key] = value
+			return true
+		})
+		if !maps.Equal(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+	check(pm)
+	if n := pm.PendingCount(); n != 0 {
+		t.Errorf("Expected pending changes to be superseded, got %d", n)
+	}
+
+	// Readers see either the old or the new contents, writers are applied before or after
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for !stop.Load() {
+			seen := map[string]bool{}
+			pm.Range(func(key string, _ int) bool {
+				seen[key] = true
+				return true
+			})
+			if seen["old"] && seen["new"] {
+				t.Error("Observed a mix of the old and new contents")
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			pm.Set("w", i)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		pm.ReplaceAll(map[string]int{"old": i})
+		pm.ReplaceAll(map[string]int{"new": i})
+	}
+	stop.Store(true)
+	wg.Wait()
+	want = map[string]int{"new": 49}
+	if w, ok := pm.Get("w"); ok {
+		want["w"] = w
+	}
+	check(pm)
+	store.Close()
+
+	store = New()
+	pm, _ = Map[int](store, "m")
+	if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	check(pm)
+}
+
+// testBatchWriteOrder runs batch while keys are set concurrently, then checks that
+// the reopened WAL matches the memory, i.e. both have the writes in the same order
+func testBatchWriteOrder(t *testing.T, batch func(pm *PersistMap[int], keys []string)) {
+	t.Helper()
+	f := NewMemFile(nil)
+	store := New(WithSyncInterval(0))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	keys := []string{"a", "b", "c", "d"}
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				pm.Set(keys[(i+w)%len(keys)], i)
+			}
+		}()
+	}
+	for i := 0; i < 300; i++ {
+		batch(pm, keys)
+	}
+	stop.Store(true)
+	wg.Wait()
+	expected := mapContents(pm)
+	store.Close()
+
+	store = New()
+	pm, _ = Map[int](store, "m")
+	if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if got := mapContents(pm); !maps.Equal(got, expected) {
+		t.Errorf("Reopened map %v differs from memory %v", got, expected)
+	}
+}
+
+// TestPersistMap_DeleteManyOrder tests that DeleteMany orders records like memory
+func TestPersistMap_DeleteManyOrder(t *testing.T) {
+	testBatchWriteOrder(t, func(pm *PersistMap[int], keys []string) {
+		pm.DeleteMany(keys)
+	})
+}
+
+// TestPersistMap_DeleteWhereOrder tests that DeleteWhere orders records like memory
+func TestPersistMap_DeleteWhereOrder(t *testing.T) {
+	testBatchWriteOrder(t, func(pm *PersistMap[int], keys []string) {
+		pm.DeleteWhere(func(string, int) bool { return true })
+	})
+}
+
+// TestPersistMap_RangeUpdateOrder tests that RangeUpdate orders records like memory
+func TestPersistMap_RangeUpdateOrder(t *testing.T) {
+	testBatchWriteOrder(t, func(pm *PersistMap[int], keys []string) {
+		pm.RangeUpdate(func(key string, upd *Update[int]) {
+			upd.Value = -upd.Value
+		})
+	})
+}
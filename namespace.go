@@ -0,0 +1,122 @@
+package persist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// In the compact keys format (see WithCompactKeys), keys carry a numeric ID of their
+// namespace instead of the map name, e.g. "S 1:alice" for the key "users:alice".
+// IDs are defined by "N" records, written along with the first record using them:
+//
+//	N 1
+//	users
+//
+// Shrink defines all known IDs at the start of the compacted WAL, except for IDs
+// allocated while it runs, which are defined at its end. So an ID may be used before
+// its definition, and loading holds such records back until the ID is defined.
+
+// compactKeysFlag marks the compact keys format in the WAL header
+const compactKeysFlag = "ns"
+
+// namespaces maps namespaces (map names) to their IDs in the compact keys format
+type namespaces struct {
+	mu      sync.Mutex // serializes the allocation of IDs
+	ids     *xsync.Map // namespace -> ID
+	names   *xsync.Map // ID -> namespace
+	next    int        // next ID to allocate
+	written int        // IDs below written+1 are defined in the WAL, protected by Store.mu
+}
+
+func newNamespaces() *namespaces {
+	return &namespaces{ids: xsync.NewMap(), names: xsync.NewMap(), next: 1}
+}
+
+// encodeKey returns fullKey with its namespace replaced by the ID, allocating an
+// ID for a new namespace. Keys without a namespace are returned as is.
+func (ns *namespaces) encodeKey(fullKey string) string {
+	idx := strings.IndexByte(fullKey, ':')
+	if idx < 0 {
+		return fullKey
+	}
+	name := fullKey[:idx]
+	id, ok := ns.ids.Load(name)
+	if !ok {
+		ns.mu.Lock()
+		if id, ok = ns.ids.Load(name); !ok {
+			newID := strconv.Itoa(ns.next)
+			ns.next++
+			ns.names.Store(newID, name)
+			ns.ids.Store(name, newID)
+			id = newID
+		}
+		ns.mu.Unlock()
+	}
+	return id.(string) + fullKey[idx:]
+}
+
+// decodeKey returns key with its namespace ID replaced by the name. Returns false
+// if the ID is not defined.
+func (ns *namespaces) decodeKey(key string) (string, bool) {
+	idx := strings.IndexByte(key, ':')
+	if idx < 0 {
+		return key, true
+	}
+	name, ok := ns.names.Load(key[:idx])
+	if !ok {
+		return key, false
+	}
+	return name.(string) + key[idx:], true
+}
+
+// define adds the ID of a namespace read from the WAL. Repeated definitions of the
+// same ID must match.
+func (ns *namespaces) define(id, name string) error {
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 || strconv.Itoa(n) != id {
+		return fmt.Errorf("%w: namespace ID `%s`", errInvalidRecord, id)
+	}
+	if existing, ok := ns.names.Load(id); ok {
+		if existing.(string) != name {
+			return fmt.Errorf("%w: namespace ID %s is defined as `%s` and `%s`", errInvalidRecord, id, existing, name)
+		}
+		return nil
+	}
+	if existing, ok := ns.ids.Load(name); ok {
+		return fmt.Errorf("%w: namespace `%s` is defined with IDs %s and %s", errInvalidRecord, name, existing, id)
+	}
+	ns.names.Store(id, name)
+	ns.ids.Store(name, id)
+	ns.mu.Lock()
+	ns.next = max(ns.next, n+1)
+	ns.mu.Unlock()
+	return nil
+}
+
+// definitions returns the "N" records of IDs from first to last, the last allocated one
+func (s *Store) definitions(first int) (records []string, last int) {
+	s.ns.mu.Lock()
+	last = s.ns.next - 1
+	s.ns.mu.Unlock()
+	for n := first; n <= last; n++ {
+		id := strconv.Itoa(n)
+		if name, ok := s.ns.names.Load(id); ok {
+			records = append(records, s.formatRecord("N", id, name.(string)))
+		}
+	}
+	return records, last
+}
+
+// reset forgets all IDs, e.g. after a failed load
+func (ns *namespaces) reset() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.ids.Clear()
+	ns.names.Clear()
+	ns.next = 1
+	ns.written = 0
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package persist
+
+import "syscall"
+
+// isNetworkFS reports whether path is on a network filesystem
+func isNetworkFS(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	switch uint32(st.Type) {
+	case 0x6969, // NFS
+		0x517B,     // SMB
+		0xFF534D42, // CIFS
+		0xFE534D42, // SMB2
+		0x00C36400: // Ceph
+		return true
+	}
+	return false
+}
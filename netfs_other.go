@@ -0,0 +1,8 @@
+//go:build !linux
+
+package persist
+
+// isNetworkFS can't detect network filesystems on this platform
+func isNetworkFS(path string) bool {
+	return false
+}
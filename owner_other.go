@@ -0,0 +1,10 @@
+//go:build !unix
+
+package persist
+
+import "os"
+
+// copyOwner is a no-op on platforms without unix file ownership
+func copyOwner(f *os.File, info os.FileInfo) error {
+	return nil
+}
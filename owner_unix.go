@@ -0,0 +1,24 @@
+//go:build unix
+
+package persist
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// copyOwner sets the owner of f to match the file described by info. It's best
+// effort: a process that may write a WAL owned by another user usually can't give
+// files away, so EPERM and ENOTSUP are ignored and the file keeps the process owner.
+func copyOwner(f *os.File, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := f.Chown(int(st.Uid), int(st.Gid))
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	}
+	return err
+}
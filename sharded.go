@@ -0,0 +1,205 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"sync"
+)
+
+// ShardedMap is one logical map spread by key hash across several WAL files, each
+// being a normal PersistMap with its own Store. Loading and Shrink run per shard in
+// parallel, and each file stays smaller, avoiding the rewrite of one huge WAL.
+//
+// The number of shards must stay the same for a given set of files, as keys would
+// be routed to different shards otherwise. It's recorded in the metadata of every
+// shard (the "shards" and "shard" keys, see WithMetadata), and OpenShardedMap
+// returns ErrShardCount if it differs.
+type ShardedMap[T any] struct {
+	shards []*PersistMap[T]
+}
+
+// OpenShardedMap opens (or creates) a map sharded across n files named "path.0",
+// "path.1", ..., like OpenSingleMap does for a single file. opts are applied to
+// the store of every shard. Shards are loaded in parallel.
+//
+// Returns ErrShardCount if the files were created with a different n, or are
+// shards of another map. Files created by versions without this check are not
+// verified.
+func OpenShardedMap[T any](path string, n int, opts ...Option) (*ShardedMap[T], error) {
+	if n < 1 {
+		return nil, errors.New("number of shards must be positive")
+	}
+	sm := &ShardedMap[T]{shards: make([]*PersistMap[T], n)}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range sm.shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shardOpts := append(opts[:len(opts):len(opts)], withShardMetadata(i, n))
+			sm.shards[i], errs[i] = OpenSingleMapWithOptions[T](path+"."+strconv.Itoa(i), shardOpts...)
+			if errs[i] == nil {
+				errs[i] = checkShard(sm.shards[i].Store, i, n)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		for _, pm := range sm.shards {
+			if pm != nil {
+				pm.Store.Close()
+			}
+		}
+		return nil, err
+	}
+	return sm, nil
+}
+
+// withShardMetadata adds the shard index and count to the metadata of new files,
+// keeping the metadata set by other options
+func withShardMetadata(i, n int) Option {
+	return func(s *Store) {
+		metadata := maps.Clone(s.metadata)
+		if metadata == nil {
+			metadata = make(map[string]string, 2)
+		}
+		metadata["shard"] = strconv.Itoa(i)
+		metadata["shards"] = strconv.Itoa(n)
+		s.metadata = metadata
+	}
+}
+
+// checkShard returns ErrShardCount if the metadata of s records another shard
+// than shard i of n. Files without the metadata are accepted.
+func checkShard(s *Store, i, n int) error {
+	metadata := s.Metadata()
+	shards, ok := metadata["shards"]
+	if !ok {
+		return nil
+	}
+	if shards != strconv.Itoa(n) || metadata["shard"] != strconv.Itoa(i) {
+		return fmt.Errorf("go-persist: %s is shard %s of %s, opened as shard %d of %d: %w",
+			s.Path(), metadata["shard"], shards, i, n, ErrShardCount)
+	}
+	return nil
+}
+
+// shard returns the shard responsible for key, using the FNV-1a hash of the key
+func (sm *ShardedMap[T]) shard(key string) *PersistMap[T] {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return sm.shards[hash%uint32(len(sm.shards))]
+}
+
+// Shards returns the underlying maps, e.g. to access their stores.
+func (sm *ShardedMap[T]) Shards() []*PersistMap[T] {
+	return sm.shards
+}
+
+// Get retrieves the value associated with the key, see PersistMap.Get
+func (sm *ShardedMap[T]) Get(key string) (T, bool) {
+	return sm.shard(key).Get(key)
+}
+
+// Has reports whether the key exists, see PersistMap.Has
+func (sm *ShardedMap[T]) Has(key string) bool {
+	return sm.shard(key).Has(key)
+}
+
+// SetAsync updates the value in memory and defers its persistence, see PersistMap.SetAsync
+func (sm *ShardedMap[T]) SetAsync(key string, value T) {
+	sm.shard(key).SetAsync(key, value)
+}
+
+// Set updates the value and writes it to the WAL immediately, see PersistMap.Set
+func (sm *ShardedMap[T]) Set(key string, value T) {
+	sm.shard(key).Set(key, value)
+}
+
+// SetFSync updates the value, writes it to the WAL and fsyncs, see PersistMap.SetFSync
+func (sm *ShardedMap[T]) SetFSync(key string, value T) error {
+	return sm.shard(key).SetFSync(key, value)
+}
+
+// DeleteAsync removes the key from memory and defers its persistence, see PersistMap.DeleteAsync
+func (sm *ShardedMap[T]) DeleteAsync(key string) bool {
+	return sm.shard(key).DeleteAsync(key)
+}
+
+// Delete removes the key and writes it to the WAL immediately, see PersistMap.Delete
+func (sm *ShardedMap[T]) Delete(key string) bool {
+	return sm.shard(key).Delete(key)
+}
+
+// UpdateAsync atomically updates the key in memory, see PersistMap.UpdateAsync
+func (sm *ShardedMap[T]) UpdateAsync(key string, updater func(upd *Update[T])) (T, bool) {
+	return sm.shard(key).UpdateAsync(key, updater)
+}
+
+// Update atomically updates the key and writes it to the WAL immediately, see PersistMap.Update
+func (sm *ShardedMap[T]) Update(key string, updater func(upd *Update[T])) (T, bool) {
+	return sm.shard(key).Update(key, updater)
+}
+
+// Range calls f for each key and value in all shards, one shard after another.
+// If f returns false, range stops the iteration.
+func (sm *ShardedMap[T]) Range(f func(key string, value T) bool) {
+	for _, pm := range sm.shards {
+		stopped := false
+		pm.Range(func(key string, value T) bool {
+			if !f(key, value) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// Size returns the total number of keys in all shards
+func (sm *ShardedMap[T]) Size() int {
+	size := 0
+	for _, pm := range sm.shards {
+		size += pm.Size()
+	}
+	return size
+}
+
+// each calls f for the store of every shard in parallel, joining the errors
+func (sm *ShardedMap[T]) each(f func(s *Store) error) error {
+	errs := make([]error, len(sm.shards))
+	var wg sync.WaitGroup
+	for i, pm := range sm.shards {
+		wg.Add(1)
+		go func(i int, s *Store) {
+			defer wg.Done()
+			errs[i] = f(s)
+		}(i, pm.Store)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Shrink compacts the WAL files of all shards in parallel, see Store.Shrink
+func (sm *ShardedMap[T]) Shrink() error {
+	return sm.each((*Store).Shrink)
+}
+
+// FSyncAll writes pending changes of all shards and fsyncs them, see Store.FSyncAll
+func (sm *ShardedMap[T]) FSyncAll() error {
+	return sm.each((*Store).FSyncAll)
+}
+
+// Close closes the stores of all shards
+func (sm *ShardedMap[T]) Close() error {
+	return sm.each((*Store).Close)
+}
@@ -0,0 +1,87 @@
+package persist
+
+// valueKey is the key of the value in the underlying map of PersistValue
+const valueKey = "value"
+
+// PersistValue is a single persistent value of type T, e.g. application config.
+// It's a thin wrapper over a one-entry PersistMap, see OpenValue.
+type PersistValue[T any] struct {
+	Store *Store // underlying WAL store
+	pm    *PersistMap[T]
+}
+
+// OpenValue opens (or creates) a file storing a single value of type T,
+// like OpenSingleMap does for maps. Auto-shrink keeps the WAL from growing
+// with every update.
+//
+// Example usage:
+//
+//	cfg, err := persist.OpenValue[Config]("config.db")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer cfg.Store.Close()
+//	cfg.Update(func(c *Config) { c.Theme = "dark" })
+func OpenValue[T any](path string, opts ...Option) (*PersistValue[T], error) {
+	pm, err := OpenSingleMapWithOptions[T](path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &PersistValue[T]{Store: pm.Store, pm: pm}, nil
+}
+
+// Get returns the current value, or the zero value of T if it was never set.
+func (pv *PersistValue[T]) Get() T {
+	value, _ := pv.pm.Get(valueKey)
+	return value
+}
+
+// Exists reports whether the value was ever set.
+func (pv *PersistValue[T]) Exists() bool {
+	return pv.pm.Has(valueKey)
+}
+
+// SetAsync updates the value in memory, deferring persistence to the background sync.
+func (pv *PersistValue[T]) SetAsync(value T) {
+	pv.pm.SetAsync(valueKey, value)
+}
+
+// Set updates the value and writes it to the WAL immediately, but without fsync.
+func (pv *PersistValue[T]) Set(value T) {
+	pv.pm.Set(valueKey, value)
+}
+
+// SetFSync updates the value, writes it to the WAL and forces a disk flush (fsync).
+func (pv *PersistValue[T]) SetFSync(value T) error {
+	return pv.pm.SetFSync(valueKey, value)
+}
+
+// update wraps updater for PersistMap update methods
+func (pv *PersistValue[T]) update(updater func(value *T)) func(upd *Update[T]) {
+	return func(upd *Update[T]) {
+		updater(&upd.Value)
+	}
+}
+
+// UpdateAsync atomically modifies the value in memory, deferring persistence to
+// the background sync. Returns the new value.
+func (pv *PersistValue[T]) UpdateAsync(updater func(value *T)) T {
+	value, _ := pv.pm.UpdateAsync(valueKey, pv.update(updater))
+	return value
+}
+
+// Update atomically modifies the value and writes it to the WAL immediately,
+// but without fsync. Returns the new value.
+//
+// The updater receives the current value (zero value if never set) and may modify it in place.
+func (pv *PersistValue[T]) Update(updater func(value *T)) T {
+	value, _ := pv.pm.Update(valueKey, pv.update(updater))
+	return value
+}
+
+// UpdateFSync atomically modifies the value, writes it to the WAL and forces
+// a disk flush (fsync). Returns the new value.
+func (pv *PersistValue[T]) UpdateFSync(updater func(value *T)) (T, error) {
+	value, _, err := pv.pm.UpdateFSync(valueKey, pv.update(updater))
+	return value, err
+}
@@ -1,12 +1,31 @@
 package persist
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v3"
 )
 
 // createTempStore creates a temporary WAL file and returns a new Store instance.
@@ -100,13 +119,34 @@ func TestStore_Shrink(t *testing.T) {
 		t.Fatalf("failed to delete key 'b': %v", err)
 	}
 
+	// Estimate the effect of the shrink
+	currentBytes, estimatedBytes, droppable, err := store.ShrinkEstimate()
+	if err != nil {
+		t.Fatalf("failed to estimate shrink: %v", err)
+	}
+	if droppable != 3 {
+		t.Fatalf("expected 3 droppable records, got %d", droppable)
+	}
+	if estimatedBytes >= currentBytes {
+		t.Fatalf("expected estimated size %d to be less than current %d", estimatedBytes, currentBytes)
+	}
+
 	// Perform the shrink (compaction) operation
 	if err := store.Shrink(); err != nil {
 		t.Fatalf("failed to shrink store: %v", err)
 	}
+	if store.IsShrinking() {
+		t.Fatal("expected IsShrinking to be false after shrink")
+	}
+	if at, _ := store.LastShrink(); at.IsZero() {
+		t.Fatal("expected LastShrink to report the completed shrink")
+	}
+	if stat, _ := os.Stat(store.Path()); stat.Size() != estimatedBytes {
+		t.Fatalf("expected size after shrink to be %d, got %d", estimatedBytes, stat.Size())
+	}
 
 	store2 := New()
-	store2.Open(store.path)
+	store2.Open(store.Path())
 	defer store2.Close()
 
 	// Verify that key "a" holds the updated value
@@ -239,6 +279,135 @@ func TestStore_IncompleteRecord(t *testing.T) {
 	}
 }
 
+// TestStore_TornWrites simulates a crash at every byte of the WAL: the store must load
+// all records written completely, cut off the torn one and stay writable.
+func TestStore_TornWrites(t *testing.T) {
+	quiet := WithLogger(log.New(io.Discard, "", 0))
+	for _, checksums := range []bool{false, true} {
+		// Record the WAL size and the expected contents after each write
+		mem := NewMemFile(nil)
+		store := New(WithChecksums(), quiet)
+		if !checksums {
+			store = New(quiet)
+		}
+		pm, _ := Map[int](store, "m")
+		if err := store.OpenFile(mem); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		sizes := []int{len(mem.Bytes())}
+		states := []map[string]int{{}}
+		state := map[string]int{}
+		for i, op := range []string{"a", "b", "bb", "-a", "c"} {
+			if op[0] == '-' {
+				pm.Delete(op[1:])
+				delete(state, op[1:])
+			} else {
+				pm.Set(op, i*1000+i)
+				state[op] = i*1000 + i
+			}
+			sizes = append(sizes, len(mem.Bytes()))
+			states = append(states, maps.Clone(state))
+		}
+		store.Close()
+		data := mem.Bytes()
+
+		for cut := sizes[0]; cut <= len(data); cut++ {
+			// Number of records written completely
+			written := 0
+			for written+1 < len(sizes) && sizes[written+1] <= cut {
+				written++
+			}
+			torn := NewMemFile(bytes.Clone(data[:cut]))
+			store := New(quiet)
+			pm, _ := Map[int](store, "m")
+			if err := store.OpenFile(torn); err != nil {
+				t.Fatalf("checksums %v, cut at %d: failed to open: %v", checksums, cut, err)
+			}
+			if !maps.Equal(mapContents(pm), states[written]) {
+				t.Errorf("checksums %v, cut at %d: expected %v, got %v", checksums, cut, states[written], mapContents(pm))
+			}
+			if _, walRecords := store.Stats(); walRecords != int32(written) {
+				t.Errorf("checksums %v, cut at %d: expected %d WAL records, got %d", checksums, cut, written, walRecords)
+			}
+			if size, _ := torn.Size(); size != int64(sizes[written]) {
+				t.Errorf("checksums %v, cut at %d: expected WAL cut to %d bytes, got %d", checksums, cut, sizes[written], size)
+			}
+			pm.Set("new", 1)
+			store.Close()
+
+			// New records must not be glued to the torn one
+			store = New(quiet)
+			pm, _ = Map[int](store, "m")
+			if err := store.OpenFile(torn); err != nil {
+				t.Fatalf("checksums %v, cut at %d: failed to reopen: %v", checksums, cut, err)
+			}
+			if val, _ := pm.Get("new"); val != 1 || pm.Size() != len(states[written])+1 {
+				t.Errorf("checksums %v, cut at %d: unexpected contents after reopen: %v", checksums, cut, mapContents(pm))
+			}
+			store.Close()
+		}
+	}
+}
+
+// mapContents returns a copy of the contents of pm
+func mapContents[T any](pm *PersistMap[T]) map[string]T {
+	contents := make(map[string]T)
+	pm.Range(func(key string, value T) bool {
+		contents[key] = value
+		return true
+	})
+	return contents
+}
+
+// TestStore_TornWriteGarbage tests torn records followed by garbage, e.g. of a reused
+// file region, as well as damage in the middle of the WAL, which must fail Open.
+// A complete last record whose value fails to decode must fail Open too, as it may
+// be valid data of another type, which mustn't be cut off.
+func TestStore_TornWriteGarbage(t *testing.T) {
+	quiet := WithLogger(log.New(io.Discard, "", 0))
+	valid := WalHeader + "\nS m:a\n1\n"
+	for _, tc := range []struct {
+		name string
+		wal  string
+		ok   bool
+	}{
+		{"nul bytes", valid + "\x00\x00\x00", true},
+		{"nul lines", valid + "\x00\x00\n\x00\n\x00", true},
+		{"partial value with garbage", valid + "S m:b\n{\"x\": [1, 2\u007f\u0001garbage\nmore garbage", false},
+		{"value with garbage line at the end", valid + "S m:b\n[1, 2garbage\n", false},
+		{"value of another type at the end", valid + "S m:b\n\"hello\"\n", false},
+		{"garbage header", valid + "garbage\n\n", true},
+		{"delete with value", valid + "D m:a\n1\n", true},
+		{"damaged record in the middle", valid + "garbage\n\nS m:b\n2\n", false},
+		{"damaged value in the middle", valid + "S m:b\n[1, 2garbage\nS m:c\n3\n", false},
+	} {
+		store := New(quiet)
+		pm, _ := Map[int](store, "m")
+		f := NewMemFile([]byte(tc.wal))
+		err := store.OpenFile(f)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: expected error for damaged WAL", tc.name)
+				store.Close()
+			} else if string(f.Bytes()) != tc.wal {
+				t.Errorf("%s: expected the WAL to be left unchanged, got %q", tc.name, f.Bytes())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to open: %v", tc.name, err)
+			continue
+		}
+		if val, ok := pm.Get("a"); !ok || val != 1 || pm.Size() != 1 {
+			t.Errorf("%s: expected only the valid record, got %v", tc.name, mapContents(pm))
+		}
+		if _, walRecords := store.Stats(); walRecords != 1 {
+			t.Errorf("%s: expected 1 WAL record, got %d", tc.name, walRecords)
+		}
+		store.Close()
+	}
+}
+
 // TestStore_RecordValueWithoutNewline tests that if the last record's value does not end with a newline,
 // then the record is treated as incomplete and skipped.
 func TestStore_RecordValueWithoutNewline(t *testing.T) {
@@ -395,3 +564,2523 @@ func TestStore_InvalidRecordMidFile(t *testing.T) {
 	// 	t.Errorf("expected ErrKeyNotFound for key 'second', got: %v", err)
 	// }
 }
+
+// TestStore_RangeOrphans tests enumeration of records that do not belong to any registered map
+func TestStore_RangeOrphans(t *testing.T) {
+	store, path := createTempStore(t)
+
+	if err := store.Set("users:alice", 1); err != nil {
+		t.Fatalf("failed to set key 'users:alice': %v", err)
+	}
+	if err := store.Set("typo:bob", 2); err != nil {
+		t.Fatalf("failed to set key 'typo:bob': %v", err)
+	}
+
+	// Reopen with only the "users" map registered
+	store2 := New()
+	if _, err := Map[int](store2, "users"); err != nil {
+		t.Fatalf("failed to create map 'users': %v", err)
+	}
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+
+	orphans := make(map[string]string)
+	err := store2.RangeOrphans(func(key, rawValue string) bool {
+		orphans[key] = rawValue
+		return true
+	})
+	if err != nil {
+		t.Fatalf("RangeOrphans failed: %v", err)
+	}
+	if len(orphans) != 1 || orphans["typo:bob"] != "2" {
+		t.Fatalf("expected only orphan 'typo:bob' with value 2, got %v", orphans)
+	}
+	if count := store2.OrphanCount(); count != 1 {
+		t.Fatalf("expected OrphanCount 1, got %d", count)
+	}
+}
+
+// TestStore_QuiesceResume tests that a quiesced store rejects writes but keeps serving reads
+func TestStore_QuiesceResume(t *testing.T) {
+	store, path := createTempStore(t)
+	pm, err := Map[int](store, "m")
+	if err != nil {
+		t.Fatalf("failed to create map: %v", err)
+	}
+	if err := store.Set("a", 1); err != nil {
+		t.Fatalf("failed to set key 'a': %v", err)
+	}
+
+	if err := store.Quiesce(); err != nil {
+		t.Fatalf("failed to quiesce store: %v", err)
+	}
+	if err := store.Set("b", 2); !errors.Is(err, ErrQuiesced) {
+		t.Fatalf("expected ErrQuiesced, got: %v", err)
+	}
+	if val, err := Get[int](store, "a"); err != nil || val != 1 {
+		t.Fatalf("expected key 'a' to be readable while quiesced, got %d, %v", val, err)
+	}
+
+	// Async changes are kept in memory until Resume
+	pm.SetAsync("x", 10)
+	if err := store.FSyncAll(); err != nil {
+		t.Fatalf("FSyncAll failed while quiesced: %v", err)
+	}
+
+	store.Resume()
+	if err := store.FSyncAll(); err != nil {
+		t.Fatalf("FSyncAll failed after resume: %v", err)
+	}
+
+	store2 := New()
+	pm2, _ := Map[int](store2, "m")
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if val, _ := pm2.Get("x"); val != 10 {
+		t.Fatalf("expected key 'x' to be persisted after resume, got %d", val)
+	}
+}
+
+// TestStore_QuiesceMapWrites tests that immediate writes of a quiesced store leave the
+// map unchanged, and that Close writes pending changes of Async methods
+func TestStore_QuiesceMapWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quiesced.wal")
+	store := New(WithSyncInterval(0))
+	var handled atomic.Int32
+	store.ErrorHandler = func(err error) {
+		if !errors.Is(err, ErrQuiesced) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		handled.Add(1)
+	}
+	pm, _ := Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	pm.Set("c", 3)
+	if err := store.Quiesce(); err != nil {
+		t.Fatalf("failed to quiesce store: %v", err)
+	}
+
+	pm.Set("a", 1)
+	if err := pm.SetFSync("a", 1); !errors.Is(err, ErrQuiesced) {
+		t.Errorf("SetFSync: expected ErrQuiesced, got %v", err)
+	}
+	pm.Update("c", func(upd *Update[int]) { upd.Value = 30 })
+	pm.Delete("c")
+	if pm.SetIfAbsent("d", 4) {
+		t.Error("SetIfAbsent: expected the value not to be stored")
+	}
+	if _, ok := pm.Pop("c"); ok {
+		t.Error("Pop: expected the key to be kept")
+	}
+	if pm.UpdateIf("c", func(int, bool) bool { return true }, func(upd *Update[int]) { upd.Value = 30 }) {
+		t.Error("UpdateIf: expected the update not to be applied")
+	}
+	if pm.Rename("c", "e") {
+		t.Error("Rename: expected the key to be kept")
+	}
+	if n := pm.DeleteMany([]string{"c"}); n != 0 {
+		t.Errorf("DeleteMany: expected no keys deleted, got %d", n)
+	}
+	if n := pm.DeleteWhere(func(string, int) bool { return true }); n != 0 {
+		t.Errorf("DeleteWhere: expected no keys deleted, got %d", n)
+	}
+	// Only the methods without a result report it
+	if n := handled.Load(); n != 3 {
+		t.Errorf("expected 3 errors reported to the ErrorHandler, got %d", n)
+	}
+	if v, ok := pm.Get("c"); !ok || v != 3 || pm.Has("a") || pm.Has("d") {
+		t.Errorf("expected the map to stay unchanged, got c=%d, a: %v, d: %v", v, pm.Has("a"), pm.Has("d"))
+	}
+
+	// Close writes the pending change without Resume
+	pm.SetAsync("b", 2)
+	if err := store.Close(); err != nil {
+		t.Fatalf("failed to close store: %v", err)
+	}
+	store = New()
+	pm, _ = Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if v, ok := pm.Get("b"); !ok || v != 2 {
+		t.Errorf("expected the async change to be written on Close, got %d, %v", v, ok)
+	}
+	if pm.Has("a") || pm.Size() != 2 {
+		t.Errorf("expected only b and c after reopening, got %d keys", pm.Size())
+	}
+}
+
+// TestStore_Freeze tests that a frozen store rejects writes without changing maps,
+// stops its background goroutines and keeps serving reads
+func TestStore_Freeze(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frozen.wal")
+	store := New(WithSyncInterval(time.Millisecond), WithAutoShrink(time.Millisecond, 2))
+	var handled atomic.Int32
+	store.ErrorHandler = func(err error) {
+		if errors.Is(err, ErrFrozen) {
+			handled.Add(1)
+		}
+	}
+	pm, _ := Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	pm.Set("a", 1)
+	pm.SetAsync("b", 2)
+
+	if err := store.Freeze(); err != nil {
+		t.Fatalf("Freeze failed: %v", err)
+	}
+	if !store.IsFrozen() {
+		t.Fatal("expected the store to be frozen")
+	}
+	pm.Set("a", 10)
+	pm.SetAsync("c", 3)
+	pm.Delete("b")
+	pm.Update("a", func(upd *Update[int]) { upd.Value++ })
+	if err := pm.SetFSync("a", 10); !errors.Is(err, ErrFrozen) {
+		t.Errorf("expected ErrFrozen from SetFSync, got: %v", err)
+	}
+	for name, err := range map[string]error{
+		"Store.Set":   store.Set("x", 1),
+		"WriteMarker": store.WriteMarker("m", nil),
+		"Shrink":      store.Shrink(),
+	} {
+		if !errors.Is(err, ErrFrozen) {
+			t.Errorf("expected ErrFrozen from %s, got: %v", name, err)
+		}
+	}
+	if handled.Load() != 4 {
+		t.Errorf("expected 4 errors reported to the ErrorHandler, got %d", handled.Load())
+	}
+	if got := mapContents(pm); len(got) != 2 || got["a"] != 1 || got["b"] != 2 {
+		t.Errorf("expected maps to stay unchanged, got %v", got)
+	}
+	store.Close()
+
+	// Open an already built dataset read-only
+	store = New(WithReadOnlyAfterLoad())
+	pm, _ = Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if v, _ := pm.Get("b"); v != 2 || !store.IsFrozen() {
+		t.Errorf("expected a frozen store with persisted data, got %v", mapContents(pm))
+	}
+	if err := pm.DeleteFSync("a"); !errors.Is(err, ErrFrozen) {
+		t.Errorf("expected ErrFrozen, got: %v", err)
+	}
+}
+
+// TestStore_AutoShrinkSizeTrigger tests that overwrites of large values trigger shrinking
+// by size even when the record ratio stays low
+func TestStore_AutoShrinkSizeTrigger(t *testing.T) {
+	store, _ := createTempStore(t)
+	for i := 0; i < 100; i++ {
+		if err := store.Set("key"+strconv.Itoa(i), i); err != nil {
+			t.Fatalf("failed to set key: %v", err)
+		}
+	}
+	blob := strings.Repeat("x", 10000)
+	if err := store.Set("blob", blob); err != nil {
+		t.Fatalf("failed to set blob: %v", err)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("failed to shrink store: %v", err)
+	}
+
+	// Overwrite the large value a few times
+	for i := 0; i < 3; i++ {
+		if err := store.Set("blob", blob); err != nil {
+			t.Fatalf("failed to set blob: %v", err)
+		}
+	}
+	if store.needsShrink(1.8) {
+		t.Fatal("expected no shrink without size triggers")
+	}
+	if err := store.SetAutoShrinkSize(2, 0); err != nil {
+		t.Fatalf("failed to set size triggers: %v", err)
+	}
+	if !store.needsShrink(1.8) {
+		t.Fatal("expected shrink by size ratio")
+	}
+	if err := store.SetAutoShrinkSize(0, 1<<20); err != nil {
+		t.Fatalf("failed to set size triggers: %v", err)
+	}
+	if store.needsShrink(1.8) {
+		t.Fatal("expected no shrink below max size")
+	}
+	if err := store.SetAutoShrinkSize(0, 20000); err != nil {
+		t.Fatalf("failed to set size triggers: %v", err)
+	}
+	if !store.needsShrink(1.8) {
+		t.Fatal("expected shrink above max size")
+	}
+}
+
+// TestStore_FileModeSurvivesShrink tests that the file mode is kept after compaction
+func TestStore_FileModeSurvivesShrink(t *testing.T) {
+	// Not using os.CreateTemp, as it creates files with 0600 already
+	path := t.TempDir() + "/persist_mode_test"
+
+	store := New(WithFileMode(0600))
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Set("secret", "value"); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("failed to shrink store: %v", err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat WAL file: %v", err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600 after shrink, got %v", stat.Mode().Perm())
+	}
+
+	// Mode changed externally must be preserved as well
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatalf("failed to chmod WAL file: %v", err)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("failed to shrink store: %v", err)
+	}
+	if stat, _ := os.Stat(path); stat.Mode().Perm() != 0640 {
+		t.Fatalf("expected mode 0640 after shrink, got %v", stat.Mode().Perm())
+	}
+}
+
+// TestStore_DumpJSON tests the JSON export and import of orphan records and map contents
+func TestStore_DumpJSON(t *testing.T) {
+	store, _ := createTempStore(t)
+	pm, err := Map[[]int](store, "lists")
+	if err != nil {
+		t.Fatalf("failed to create map: %v", err)
+	}
+	pm.Set("a", []int{1, 2})
+	if err := store.Set("config", map[string]bool{"debug": true}); err != nil {
+		t.Fatalf("failed to set key 'config': %v", err)
+	}
+
+	var buf strings.Builder
+	if err := store.DumpJSON(&buf); err != nil {
+		t.Fatalf("DumpJSON failed: %v", err)
+	}
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(buf.String()), &dump); err != nil {
+		t.Fatalf("dump is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if len(dump) != 2 || string(dump["lists:a"]) != "[1,2]" || string(dump["config"]) != `{"debug":true}` {
+		t.Fatalf("unexpected dump contents:\n%s", buf.String())
+	}
+
+	// Import the dump into another store
+	store2, path2 := createTempStore(t)
+	pm2, err := Map[[]int](store2, "lists")
+	if err != nil {
+		t.Fatalf("failed to create map: %v", err)
+	}
+	if err := store2.LoadJSON(strings.NewReader(buf.String())); err != nil {
+		t.Fatalf("LoadJSON failed: %v", err)
+	}
+	if list, _ := pm2.Get("a"); len(list) != 2 || list[1] != 2 {
+		t.Fatalf("expected [1 2] for lists:a, got %v", list)
+	}
+
+	// Imported data must be persisted
+	store3 := New()
+	if err := store3.Open(path2); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store3.Close()
+	var buf3 strings.Builder
+	if err := store3.DumpJSON(&buf3); err != nil {
+		t.Fatalf("DumpJSON failed: %v", err)
+	}
+	if buf3.String() != buf.String() {
+		t.Fatalf("expected identical dumps, got:\n%s\nand:\n%s", buf.String(), buf3.String())
+	}
+}
+
+// TestStore_LoadJSONMultiline tests that pretty-printed orphan values survive Shrink
+func TestStore_LoadJSONMultiline(t *testing.T) {
+	store, path := createTempStore(t)
+	if err := store.LoadJSON(strings.NewReader("{\"k\": {\n  \"a\": 1\n}}")); err != nil {
+		t.Fatalf("LoadJSON failed: %v", err)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	store.Close()
+	if data, _ := os.ReadFile(path); !strings.HasSuffix(string(data), "\nS k\n{\"a\":1}\n") {
+		t.Errorf("expected a compacted record, got %q", data)
+	}
+
+	store2 := New()
+	if err := store2.Open(path); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store2.Close()
+	if val, err := Get[map[string]int](store2, "k"); err != nil || val["a"] != 1 {
+		t.Errorf("expected {a:1} for k, got %v, %v", val, err)
+	}
+}
+
+// TestStore_MaxRecordSize tests that oversized records are rejected on write and on load
+func TestStore_MaxRecordSize(t *testing.T) {
+	store, path := createTempStore(t)
+	if err := store.Set("big", strings.Repeat("x", 200)); err != nil {
+		t.Fatalf("failed to set key 'big': %v", err)
+	}
+
+	store2 := New(WithMaxRecordSize(100))
+	if err := store2.Open(path); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge on load, got: %v", err)
+	}
+
+	store3, _ := createTempStore(t)
+	store3.maxRecordSize = 100
+	if err := store3.Set("big", strings.Repeat("x", 200)); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge on write, got: %v", err)
+	}
+	if err := store3.Set("small", "x"); err != nil {
+		t.Fatalf("failed to set key 'small': %v", err)
+	}
+}
+
+// TestStore_LargeValue tests loading records longer than the read buffer (4096 bytes)
+func TestStore_LargeValue(t *testing.T) {
+	store, path := createTempStore(t)
+	large := strings.Repeat("0123456789", 1000)
+	if err := store.Set("large", large); err != nil {
+		t.Fatalf("failed to set key 'large': %v", err)
+	}
+	if err := store.Set("after", 1); err != nil {
+		t.Fatalf("failed to set key 'after': %v", err)
+	}
+
+	// Records must load regardless of the read buffer size
+	for _, size := range []int{16, DefaultReadBufferSize, 1 << 20} {
+		store2 := New(WithReadBufferSize(size))
+		if err := store2.Open(path); err != nil {
+			t.Fatalf("failed to reopen store with buffer %d: %v", size, err)
+		}
+		val, err := Get[string](store2, "large")
+		if err != nil {
+			t.Fatalf("failed to get key 'large': %v", err)
+		}
+		if val != large {
+			t.Fatalf("large value mismatch with buffer %d: got %d bytes", size, len(val))
+		}
+		if val, err := Get[int](store2, "after"); err != nil || val != 1 {
+			t.Fatalf("expected 1 for key 'after', got %d, %v", val, err)
+		}
+		store2.Close()
+	}
+}
+
+// TestStore_MemFile tests a store backed by an in-memory WAL, including shrink
+// and loading a WAL written to disk from bytes.
+func TestStore_MemFile(t *testing.T) {
+	mem := NewMemFile(nil)
+	store := New()
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("failed to open in-memory store: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := store.Set("key", i); err != nil {
+			t.Fatalf("failed to set key: %v", err)
+		}
+	}
+	if err := store.Set("other", "value"); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	sizeBefore := len(mem.Bytes())
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("shrink failed: %v", err)
+	}
+	if len(mem.Bytes()) >= sizeBefore {
+		t.Errorf("expected shrink to reduce size from %d, got %d", sizeBefore, len(mem.Bytes()))
+	}
+	if err := store.Delete("other"); err != nil {
+		t.Fatalf("failed to delete key: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("failed to close store: %v", err)
+	}
+
+	store2 := New()
+	if err := store2.OpenFile(NewMemFile(mem.Bytes())); err != nil {
+		t.Fatalf("failed to reopen in-memory store: %v", err)
+	}
+	defer store2.Close()
+	if val, err := Get[int](store2, "key"); err != nil || val != 9 {
+		t.Errorf("expected 9 for key 'key', got %d, %v", val, err)
+	}
+	if _, err := Get[string](store2, "other"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound for deleted key, got %v", err)
+	}
+
+	// Load a WAL from disk as bytes
+	diskStore, path := createTempStore(t)
+	diskStore.Set("disk", true)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read WAL: %v", err)
+	}
+	store3 := New()
+	if err := store3.OpenFile(NewMemFile(data)); err != nil {
+		t.Fatalf("failed to open WAL bytes: %v", err)
+	}
+	defer store3.Close()
+	if val, err := Get[bool](store3, "disk"); err != nil || !val {
+		t.Errorf("expected true for key 'disk', got %v, %v", val, err)
+	}
+
+	if err := New().OpenFile(NewMemFile([]byte("garbage\n"))); err == nil {
+		t.Errorf("expected error for invalid WAL header")
+	}
+}
+
+// TestStore_Logger tests that diagnostic messages go to the store's logger with its name.
+func TestStore_Logger(t *testing.T) {
+	var buf strings.Builder
+	store := New(WithName("users"), WithLogger(log.New(&buf, "", 0)))
+	wal := WalHeader + "\nS key\n1\nS partial\n"
+	if err := store.OpenFile(NewMemFile([]byte(wal))); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	if val, err := Get[int](store, "key"); err != nil || val != 1 {
+		t.Errorf("expected 1 for key 'key', got %d, %v", val, err)
+	}
+	if !strings.HasPrefix(buf.String(), "go-persist[users]: incomplete record") {
+		t.Errorf("expected incomplete record warning with store name, got %q", buf.String())
+	}
+}
+
+// TestStore_Checksums tests that records carry checksums with WithChecksums and
+// that a flipped byte is detected on load.
+func TestStore_Checksums(t *testing.T) {
+	mem := NewMemFile(nil)
+	store := New(WithChecksums())
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	store.Set("a", 100)
+	store.Set("b", "text")
+	store.Set("b", "other")
+	store.Delete("a")
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("shrink failed: %v", err)
+	}
+	store.Set("c", 123)
+	store.Close()
+
+	data := mem.Bytes()
+	if !strings.HasPrefix(string(data), WalHeaderChecksums+"\n") {
+		t.Fatalf("expected checksums header, got %q", data)
+	}
+
+	// Intact WAL loads, even without the option, as the format is in the header
+	store2 := New()
+	if err := store2.OpenFile(NewMemFile(data)); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	if val, err := Get[int](store2, "c"); err != nil || val != 123 {
+		t.Errorf("expected 123 for key 'c', got %d, %v", val, err)
+	}
+	if val, err := Get[string](store2, "b"); err != nil || val != "other" {
+		t.Errorf("expected 'other' for key 'b', got %q, %v", val, err)
+	}
+	store2.Close()
+
+	// A bit-flip that still parses as valid JSON is detected
+	corrupted := bytes.Replace(data, []byte(`"other"`), []byte(`"othex"`), 1)
+	err := New().OpenFile(NewMemFile(corrupted))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	// A mismatch in the last record means it was torn, it's discarded
+	store4 := New()
+	if err := store4.OpenFile(NewMemFile(bytes.Replace(data, []byte("123"), []byte("124"), 1))); err != nil {
+		t.Fatalf("failed to open WAL with torn last record: %v", err)
+	}
+	if _, err := Get[int](store4, "c"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected torn record to be discarded, got %v", err)
+	}
+	store4.Close()
+
+	// Existing files without checksums keep their format
+	plain := []byte(WalHeader + "\nS key\n1\n")
+	mem = NewMemFile(plain)
+	store3 := New(WithChecksums())
+	if err := store3.OpenFile(mem); err != nil {
+		t.Fatalf("failed to open plain WAL: %v", err)
+	}
+	store3.Set("key", 2)
+	store3.Close()
+	if string(mem.Bytes()) != WalHeader+"\nS key\n1\nS key\n2\n" {
+		t.Errorf("unexpected WAL contents: %q", mem.Bytes())
+	}
+}
+
+// syncCountingFile is a MemFile that counts Sync calls
+type syncCountingFile struct {
+	*MemFile
+	syncs int
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs++
+	return nil
+}
+
+// TestStore_FsyncOnClose tests that Close skips the fsync with WithFsyncOnClose(false),
+// but still writes pending changes.
+func TestStore_FsyncOnClose(t *testing.T) {
+	for _, fsync := range []bool{true, false} {
+		f := &syncCountingFile{MemFile: NewMemFile([]byte(WalHeader + "\n"))}
+		store := New(WithFsyncOnClose(fsync))
+		pm, _ := Map[int](store, "m")
+		if err := store.OpenFile(f); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		pm.SetAsync("key", 1)
+		if err := store.Close(); err != nil {
+			t.Fatalf("failed to close store: %v", err)
+		}
+		if fsync != (f.syncs > 0) {
+			t.Errorf("fsyncOnClose=%v: got %d syncs", fsync, f.syncs)
+		}
+		if !strings.Contains(string(f.Bytes()), "S m:key\n1\n") {
+			t.Errorf("fsyncOnClose=%v: pending change not written: %q", fsync, f.Bytes())
+		}
+	}
+}
+
+// slowRewriteFile is a MemFile whose rewrites take a while to sync
+type slowRewriteFile struct {
+	*MemFile
+}
+
+type slowRewriter struct {
+	WALRewriter
+}
+
+func (f slowRewriteFile) Rewrite() (WALRewriter, error) {
+	rw, err := f.MemFile.Rewrite()
+	return slowRewriter{rw}, err
+}
+
+func (w slowRewriter) Sync() error {
+	time.Sleep(50 * time.Millisecond)
+	return w.WALRewriter.Sync()
+}
+
+// TestStore_Compact tests that Compact waits for a shrink in progress instead of
+// failing with ErrShrinkInProgress.
+func TestStore_Compact(t *testing.T) {
+	store := New()
+	if err := store.OpenFile(slowRewriteFile{NewMemFile(nil)}); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	store.Set("key", 1)
+
+	shrinkDone := make(chan error)
+	go func() {
+		shrinkDone <- store.Shrink()
+	}()
+	for !store.IsShrinking() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := store.Shrink(); err != ErrShrinkInProgress {
+		t.Errorf("expected ErrShrinkInProgress from Shrink, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.Compact(); err != nil {
+				t.Errorf("Compact failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := <-shrinkDone; err != nil {
+		t.Errorf("Shrink failed: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Errorf("Compact without a shrink in progress failed: %v", err)
+	}
+}
+
+// TestStore_FlushInterval tests that pending changes are written to the WAL every
+// flush interval without waiting for the fsync.
+func TestStore_FlushInterval(t *testing.T) {
+	f := &syncCountingFile{MemFile: NewMemFile([]byte(WalHeader + "\n"))}
+	store := New(WithAppendBufferFlushInterval(5*time.Millisecond), WithSyncInterval(time.Hour))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	pm.SetAsync("key", 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for pm.PendingCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !strings.Contains(string(f.Bytes()), "S m:key\n1\n") {
+		t.Errorf("expected pending change to be flushed, got %q", f.Bytes())
+	}
+	if f.syncs != 0 {
+		t.Errorf("expected no fsync before the sync interval, got %d", f.syncs)
+	}
+}
+
+// TestStore_OpenErrors tests that Open errors carry the path and a checkable cause.
+func TestStore_OpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	err := New().Open(dir)
+	if !errors.Is(err, ErrIsDirectory) || !strings.Contains(err.Error(), dir) {
+		t.Errorf("expected ErrIsDirectory with path, got %v", err)
+	}
+
+	path := filepath.Join(dir, "invalid.wal")
+	if err := os.WriteFile(path, []byte("not a wal\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = New().Open(path)
+	if !errors.Is(err, ErrInvalidHeader) || !strings.Contains(err.Error(), path) {
+		t.Errorf("expected ErrInvalidHeader with path, got %v", err)
+	}
+
+	err = New().Open(filepath.Join(dir, "missing", "store.wal"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for missing directory, got %v", err)
+	}
+
+	store, _ := createTempStore(t)
+	if err := store.Open(path); err != ErrAlreadyLoaded {
+		t.Errorf("expected ErrAlreadyLoaded, got %v", err)
+	}
+
+	// Of concurrent Opens, one succeeds and the others don't touch the file,
+	// which would fail with ErrLocked in network mode
+	store = New(WithNetworkFilesystem())
+	defer store.Close()
+	errs := make(chan error, 8)
+	for range cap(errs) {
+		go func() { errs <- store.Open(filepath.Join(dir, "concurrent.wal")) }()
+	}
+	opened := 0
+	for range cap(errs) {
+		if err := <-errs; err == nil {
+			opened++
+		} else if err != ErrAlreadyLoaded {
+			t.Errorf("expected ErrAlreadyLoaded for a concurrent Open, got %v", err)
+		}
+	}
+	if opened != 1 {
+		t.Errorf("expected exactly one Open to succeed, got %d", opened)
+	}
+}
+
+// TestStore_NetworkFilesystem tests writing at tracked offsets with the WAL locked,
+// including Shrink, and that another process can't open the locked WAL.
+func TestStore_NetworkFilesystem(t *testing.T) {
+	if path := os.Getenv("PERSIST_LOCKED_WAL"); path != "" {
+		// Helper process trying to open the WAL locked by the test
+		err := New(WithNetworkFilesystem()).Open(path)
+		if errors.Is(err, ErrLocked) {
+			os.Exit(3)
+		}
+		os.Exit(0)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.wal")
+	quiet := WithLogger(log.New(io.Discard, "", 0))
+	store := New(WithNetworkFilesystem(), quiet)
+	pm, _ := Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		pm.Set("key"+strconv.Itoa(i%10), i)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("shrink failed: %v", err)
+	}
+	pm.Set("after", 1)
+
+	if runtime.GOOS != "windows" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestStore_NetworkFilesystem$")
+		cmd.Env = append(os.Environ(), "PERSIST_LOCKED_WAL="+path)
+		var exitErr *exec.ExitError
+		if err := cmd.Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+			t.Errorf("expected another process to fail with ErrLocked, got %v", err)
+		}
+	}
+	store.Close()
+
+	store = New(WithNetworkFilesystem(), quiet)
+	pm, _ = Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if val, _ := pm.Get("key9"); val != 99 || pm.Size() != 11 {
+		t.Errorf("unexpected contents after reopen: %v", mapContents(pm))
+	}
+	if info, _ := os.Stat(path); info.Size() != mustSize(t, store) {
+		t.Errorf("expected tracked offset %d to match file size %d", mustSize(t, store), info.Size())
+	}
+}
+
+// mustSize returns the size of the store's WAL
+func mustSize(t *testing.T, store *Store) int64 {
+	size, err := store.f.Size()
+	if err != nil {
+		t.Fatalf("failed to get WAL size: %v", err)
+	}
+	return size
+}
+
+// TestStore_OrphanDecodePolicy tests the handling of orphans failing to decode in Get
+func TestStore_OrphanDecodePolicy(t *testing.T) {
+	wal := []byte(WalHeader + "\nS orphan\n\"text\"\n")
+	for _, policy := range []OrphanDecodePolicy{OrphanKeep, OrphanEvict, OrphanReport} {
+		mem := NewMemFile(bytes.Clone(wal))
+		store := New(WithOrphanDecodePolicy(policy))
+		var reported error
+		store.ErrorHandler = func(err error) {
+			reported = err
+		}
+		if err := store.OpenFile(mem); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+
+		if _, err := Get[int](store, "orphan"); err == nil {
+			t.Errorf("policy %d: expected decode error", policy)
+		}
+		if (reported != nil) != (policy == OrphanReport) {
+			t.Errorf("policy %d: unexpected ErrorHandler call: %v", policy, reported)
+		}
+		val, err := Get[string](store, "orphan")
+		if policy == OrphanEvict {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected evicted record, got %q, %v", val, err)
+			}
+			if !strings.HasSuffix(string(mem.Bytes()), "D orphan\n\n") {
+				t.Errorf("expected delete record of evicted orphan, got %q", mem.Bytes())
+			}
+		} else if err != nil || val != "text" {
+			t.Errorf("policy %d: expected record to be kept, got %q, %v", policy, val, err)
+		}
+		store.Close()
+	}
+}
+
+// TestStore_CompactionConcurrencyLimit tests that stores sharing a CompactionLimiter
+// don't auto-shrink at the same time.
+func TestStore_CompactionConcurrencyLimit(t *testing.T) {
+	limiter := NewCompactionLimiter(1)
+	stores := make([]*Store, 4)
+	for i := range stores {
+		stores[i] = New(WithCompactionConcurrencyLimit(limiter))
+		if err := stores[i].OpenFile(slowRewriteFile{NewMemFile(nil)}); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		defer stores[i].Close()
+		for j := 0; j < 10; j++ {
+			stores[i].Set("key", j)
+		}
+	}
+	for _, store := range stores {
+		if err := store.StartAutoShrink(time.Millisecond, 2); err != nil {
+			t.Fatalf("failed to start auto-shrink: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		shrinking, pending := 0, 0
+		for _, store := range stores {
+			if store.IsShrinking() {
+				shrinking++
+			}
+			if _, walRecords := store.Stats(); walRecords > 1 {
+				pending++
+			}
+		}
+		if shrinking > 1 {
+			t.Fatalf("expected at most 1 concurrent shrink, got %d", shrinking)
+		}
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d stores were not shrunk", pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestStore_FsyncOnCreate tests that Open skips the header fsync with WithFsyncOnCreate(false)
+func TestStore_FsyncOnCreate(t *testing.T) {
+	for _, fsync := range []bool{true, false} {
+		f := &syncCountingFile{MemFile: NewMemFile(nil)}
+		store := New(WithFsyncOnCreate(fsync))
+		if err := store.OpenFile(f); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		if fsync != (f.syncs > 0) {
+			t.Errorf("fsyncOnCreate=%v: got %d syncs", fsync, f.syncs)
+		}
+		store.Close()
+		if !strings.HasPrefix(string(f.Bytes()), WalHeader+"\n") {
+			t.Errorf("fsyncOnCreate=%v: expected header, got %q", fsync, f.Bytes())
+		}
+	}
+}
+
+// TestStore_ReadLog tests reading the history of writes, including from an offset
+func TestStore_ReadLog(t *testing.T) {
+	store := New()
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	pm.Set("a", 1)
+	pm.Set("a", 2)
+	offset, err := store.WALSize()
+	if err != nil {
+		t.Fatalf("WALSize failed: %v", err)
+	}
+	pm.Delete("a")
+	store.Set("b", "text")
+
+	var log []string
+	err = store.ReadLog(0, func(op, fullKey, rawValue string) bool {
+		log = append(log, op+" "+fullKey+" "+rawValue)
+		return true
+	})
+	want := []string{"S m:a 1", "S m:a 2", "D m:a ", `S b "text"`}
+	if err != nil || strings.Join(log, "|") != strings.Join(want, "|") {
+		t.Errorf("expected log %q, got %q, %v", want, log, err)
+	}
+
+	log = nil
+	store.ReadLog(offset, func(op, fullKey, rawValue string) bool {
+		log = append(log, op+" "+fullKey)
+		return len(log) < 1
+	})
+	if len(log) != 1 || log[0] != "D m:a" {
+		t.Errorf("expected log from offset to start with the delete, got %q", log)
+	}
+}
+
+// errInjected is returned by faultyFile for injected faults
+var errInjected = errors.New("disk error")
+
+// faultyFile is a MemFile injecting faults of the file layer: writes growing the
+// WAL beyond writeLimit bytes are cut off at the limit like on a full disk, Sync
+// fails while failSync is set, and readers fail after readLimit bytes.
+// Limits of 0 disable the faults. The next transient writes and syncs fail with
+// EAGAIN, writes after writing a half.
+type faultyFile struct {
+	*MemFile
+	writeLimit atomic.Int64
+	readLimit  atomic.Int64
+	failSync   atomic.Bool
+	syncDelay  atomic.Int64 // time.Duration
+	transient  atomic.Int32
+}
+
+func newFaultyFile(data []byte) *faultyFile {
+	return &faultyFile{MemFile: NewMemFile(data)}
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.takeTransient() {
+		n, _ := f.MemFile.Write(p[:len(p)/2])
+		return n, syscall.EAGAIN
+	}
+	limit := f.writeLimit.Load()
+	if limit == 0 {
+		return f.MemFile.Write(p)
+	}
+	size, _ := f.MemFile.Size()
+	if room := limit - size; int64(len(p)) > room {
+		n, _ := f.MemFile.Write(p[:max(room, 0)])
+		return n, errInjected
+	}
+	return f.MemFile.Write(p)
+}
+
+func (f *faultyFile) Sync() error {
+	time.Sleep(time.Duration(f.syncDelay.Load()))
+	if f.takeTransient() {
+		return syscall.EAGAIN
+	}
+	if f.failSync.Load() {
+		return errInjected
+	}
+	return nil
+}
+
+// takeTransient consumes one of the transient faults, if any are left
+func (f *faultyFile) takeTransient() bool {
+	for {
+		n := f.transient.Load()
+		if n <= 0 {
+			return false
+		}
+		if f.transient.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+func (f *faultyFile) NewReader() (io.ReadCloser, error) {
+	r, err := f.MemFile.NewReader()
+	if limit := f.readLimit.Load(); err == nil && limit > 0 {
+		return io.NopCloser(io.MultiReader(io.LimitReader(r, limit), iotest.ErrReader(errInjected))), nil
+	}
+	return r, err
+}
+
+// TestStore_Ping tests that Ping reports a store closed, with the WAL deleted from
+// disk, or with a failed background sync.
+func TestStore_Ping(t *testing.T) {
+	store, path := createTempStore(t)
+	if err := store.Ping(); err != nil {
+		t.Fatalf("expected healthy store, got: %v", err)
+	}
+	os.Remove(path)
+	if err := store.Ping(); err == nil {
+		t.Fatal("expected an error for the deleted WAL")
+	}
+	store.Close()
+	if err := store.Ping(); !errors.Is(err, ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed, got: %v", err)
+	}
+	if err := New().Ping(); !errors.Is(err, ErrNotLoaded) {
+		t.Fatalf("expected ErrNotLoaded, got: %v", err)
+	}
+
+	f := newFaultyFile(nil)
+	store = New(WithSyncInterval(5 * time.Millisecond))
+	store.ErrorHandler = func(error) {}
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	waitPing := func(healthy bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for (store.Ping() == nil) != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected healthy=%v, got: %v", healthy, store.Ping())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	f.failSync.Store(true)
+	waitPing(false)
+	if err := store.Ping(); !strings.Contains(err.Error(), "disk error") {
+		t.Fatalf("expected the background sync error, got: %v", err)
+	}
+	// A successful sync clears the error
+	f.failSync.Store(false)
+	waitPing(true)
+}
+
+// TestStore_Options tests that New without options uses the defaults, and that
+// options are applied before Open starts the background goroutine.
+func TestStore_Options(t *testing.T) {
+	store := New()
+	if store.GetSyncInterval() != DefaultSyncInterval {
+		t.Errorf("expected default sync interval, got %v", store.GetSyncInterval())
+	}
+	if store.maxRecordSize != DefaultMaxRecordSize || store.fileMode != 0644 || !store.fsyncOnClose {
+		t.Errorf("unexpected defaults: %d, %v, %v", store.maxRecordSize, store.fileMode, store.fsyncOnClose)
+	}
+
+	// The first background sync already fails, so it must see both options
+	f := newFaultyFile([]byte(WalHeader + "\n"))
+	f.failSync.Store(true)
+	errs := make(chan error, 1)
+	store = New(WithSyncInterval(time.Millisecond), WithErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}))
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrSyncDegraded) || !errors.Is(err, errInjected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("error handler was not called by the background sync")
+	}
+	f.failSync.Store(false)
+	store.Close()
+}
+
+// TestStore_SyncBackoff tests that repeated failures of the background sync slow it
+// down and are reported by Ping, until a sync succeeds again.
+func TestStore_SyncBackoff(t *testing.T) {
+	interval := 10 * time.Millisecond
+	for failures, want := range []time.Duration{interval, interval, interval, 2 * interval, 4 * interval} {
+		if got := syncBackoff(interval, failures); got != want {
+			t.Errorf("%d failures: expected %v, got %v", failures, want, got)
+		}
+	}
+	if got := syncBackoff(interval, 100); got != interval<<maxSyncBackoffShift {
+		t.Errorf("expected the backoff to be capped, got %v", got)
+	}
+
+	f := newFaultyFile([]byte(WalHeader + "\n"))
+	f.failSync.Store(true)
+	var handled atomic.Int32
+	store := New(WithSyncInterval(time.Millisecond), WithErrorHandler(func(error) { handled.Add(1) }))
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !errors.Is(store.Ping(), ErrSyncDegraded) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected ErrSyncDegraded, got: %v", store.Ping())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Without the backoff, there would be about 100 failures
+	time.Sleep(100 * time.Millisecond)
+	if n := store.SyncFailures(); n < syncBackoffAfter || n > 20 {
+		t.Errorf("expected the background sync to back off, got %d failures", n)
+	}
+	if n := handled.Load(); n != 1 {
+		t.Errorf("expected the degraded state to be reported once, got %d calls", n)
+	}
+
+	f.failSync.Store(false)
+	deadline = time.Now().Add(2 * time.Second)
+	for store.Ping() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the store to recover, got: %v", store.Ping())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := store.SyncFailures(); n != 0 {
+		t.Errorf("expected no failures after recovery, got %d", n)
+	}
+}
+
+// TestStore_DeferredLoad tests both orderings of registering maps: before Load with
+// WithDeferredLoad, and after a regular Open, which adopts the orphan records.
+func TestStore_DeferredLoad(t *testing.T) {
+	store, path := createTempStore(t)
+	pm, _ := Map[int](store, "m")
+	pm.Set("a", 1)
+	store.Close()
+
+	if err := New().Load(); !errors.Is(err, ErrNotOpened) {
+		t.Fatalf("expected ErrNotOpened, got: %v", err)
+	}
+
+	store = New(WithDeferredLoad())
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if err := store.Open(path); !errors.Is(err, ErrAlreadyLoaded) {
+		t.Fatalf("expected ErrAlreadyLoaded for the second Open, got: %v", err)
+	}
+	// Registered after Open, but before Load: records are loaded directly
+	pm, _ = Map[int](store, "m")
+	if err := store.Set("x", 1); !errors.Is(err, ErrNotLoaded) {
+		t.Fatalf("expected ErrNotLoaded before Load, got: %v", err)
+	}
+	if err := store.Load(); err != nil {
+		t.Fatalf("failed to load store: %v", err)
+	}
+	if err := store.Load(); !errors.Is(err, ErrAlreadyLoaded) {
+		t.Fatalf("expected ErrAlreadyLoaded, got: %v", err)
+	}
+	if val, ok := pm.Get("a"); !ok || val != 1 {
+		t.Fatalf("expected a=1, got %d, %v", val, ok)
+	}
+	if n := store.OrphanCount(); n != 0 {
+		t.Fatalf("expected no orphans, got %d", n)
+	}
+	pm.Set("b", 2)
+	store.Close()
+
+	// Registered after a regular Open: records are adopted from the orphans
+	store = New()
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if n := store.OrphanCount(); n != 2 {
+		t.Fatalf("expected 2 orphans before registering the map, got %d", n)
+	}
+	pm, _ = Map[int](store, "m")
+	if val, ok := pm.Get("b"); !ok || val != 2 {
+		t.Fatalf("expected b=2, got %d, %v", val, ok)
+	}
+	store.Close()
+
+	// A store that was never loaded can be closed, releasing the file
+	store = New(WithDeferredLoad())
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("failed to close unloaded store: %v", err)
+	}
+}
+
+// TestStore_WriteAmplification tests the ratio of WAL records to active keys.
+func TestStore_WriteAmplification(t *testing.T) {
+	store, _ := createTempStore(t)
+	defer store.Close()
+	if wa := store.WriteAmplification(); wa != 0 {
+		t.Fatalf("expected 0 for an empty WAL, got %v", wa)
+	}
+	pm, _ := Map[int](store, "m")
+	for i := range 4 {
+		pm.Set("a", i)
+	}
+	pm.Set("b", 0)
+	if wa := store.WriteAmplification(); wa != 2.5 {
+		t.Fatalf("expected 2.5, got %v", wa)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("shrink failed: %v", err)
+	}
+	if wa := store.WriteAmplification(); wa != 1 {
+		t.Fatalf("expected 1 after shrink, got %v", wa)
+	}
+	pm.Delete("a")
+	pm.Delete("b")
+	if wa := store.WriteAmplification(); !math.IsInf(wa, 1) {
+		t.Fatalf("expected +Inf without active keys, got %v", wa)
+	}
+}
+
+// TestStore_JSONOptions tests that JSON options apply to writes, Shrink and loading.
+func TestStore_JSONOptions(t *testing.T) {
+	const html = "<b>a & b</b>"
+	const big = 1<<60 + 1
+	for _, opts := range []JSONOptions{{}, {DisableHTMLEscape: true, UseNumber: true}} {
+		f := NewMemFile(nil)
+		store := New(WithJSONOptions(opts))
+		pm, _ := Map[map[string]any](store, "m")
+		if err := store.OpenFile(f); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		pm.Set("a", map[string]any{"html": html, "n": big})
+		if err := store.Set("orphan", html); err != nil {
+			t.Fatalf("failed to set orphan: %v", err)
+		}
+		if err := store.Shrink(); err != nil {
+			t.Fatalf("shrink failed: %v", err)
+		}
+		store.Close()
+
+		wal := string(f.Bytes())
+		if strings.Count(wal, html) != 2 && opts.DisableHTMLEscape || strings.Contains(wal, "<") && !opts.DisableHTMLEscape {
+			t.Errorf("%+v: unexpected escaping in WAL: %q", opts, wal)
+		}
+
+		store = New(WithJSONOptions(opts))
+		pm, _ = Map[map[string]any](store, "m")
+		if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+			t.Fatalf("failed to reopen store: %v", err)
+		}
+		val, _ := pm.Get("a")
+		if val["html"] != html {
+			t.Errorf("%+v: expected %q, got %q", opts, html, val["html"])
+		}
+		if opts.UseNumber {
+			if n, ok := val["n"].(json.Number); !ok || n.String() != strconv.Itoa(big) {
+				t.Errorf("%+v: expected exact json.Number, got %#v", opts, val["n"])
+			}
+		} else if _, ok := val["n"].(float64); !ok {
+			t.Errorf("%+v: expected float64, got %#v", opts, val["n"])
+		}
+		if s, err := Get[string](store, "orphan"); err != nil || s != html {
+			t.Errorf("%+v: expected orphan %q, got %q, %v", opts, html, s, err)
+		}
+		store.Close()
+
+		// Only spaces may follow the value
+		var v any
+		for _, data := range []string{`{"a":1} x`, `[1] [2]`, `1}`} {
+			if err := store.decodeValue([]byte(data), &v); err == nil {
+				t.Errorf("%+v: expected an error for %q", opts, data)
+			}
+		}
+		if err := store.decodeValue([]byte(` 1 `), &v); err != nil {
+			t.Errorf("%+v: expected spaces around the value to be accepted, got %v", opts, err)
+		}
+	}
+}
+
+// TestStore_FaultDiskFull tests that a write cut off by a full disk is removed from
+// the WAL, so that later writes keep it loadable.
+func TestStore_FaultDiskFull(t *testing.T) {
+	f := newFaultyFile(nil)
+	store := New(WithErrorHandler(func(error) {}))
+	pm, _ := Map[string](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	pm.Set("a", "1")
+	size := mustSize(t, store)
+
+	f.writeLimit.Store(size + 5)
+	if err := pm.SetFSync("b", strings.Repeat("x", 100)); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected error, got: %v", err)
+	}
+	if got := mustSize(t, store); got != size {
+		t.Fatalf("expected the partial write to be cut off, WAL size %d, want %d", got, size)
+	}
+	f.writeLimit.Store(0)
+	pm.Set("c", "3")
+	store.Close()
+
+	store = New()
+	pm, _ = Map[string](store, "m")
+	if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if got := mapContents(pm); !maps.Equal(got, map[string]string{"a": "1", "c": "3"}) {
+		t.Fatalf("unexpected contents after reopen: %v", got)
+	}
+}
+
+// TestStore_FaultRead tests that a read error while loading fails Open without
+// loading partial data, and that Open can be retried.
+func TestStore_FaultRead(t *testing.T) {
+	mem := NewMemFile(nil)
+	store := New()
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(mem); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	for i := range 100 {
+		pm.Set(strconv.Itoa(i), i)
+	}
+	store.Close()
+
+	f := newFaultyFile(mem.Bytes())
+	f.readLimit.Store(int64(len(mem.Bytes()) / 2))
+	store = New()
+	pm, _ = Map[int](store, "m")
+	if err := store.OpenFile(f); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected error, got: %v", err)
+	}
+	if pm.Size() != 0 {
+		t.Fatalf("expected no partially loaded keys, got %d", pm.Size())
+	}
+
+	f.readLimit.Store(0)
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to retry open: %v", err)
+	}
+	defer store.Close()
+	if pm.Size() != 100 {
+		t.Fatalf("expected 100 keys, got %d", pm.Size())
+	}
+}
+
+// TestStore_ReadLogSince tests that a follower of the log detects compaction.
+func TestStore_ReadLogSince(t *testing.T) {
+	store, _ := createTempStore(t)
+	defer store.Close()
+	pm, _ := Map[int](store, "m")
+	pm.Set("a", 1)
+
+	epoch, offset, err := store.LogPosition()
+	if err != nil {
+		t.Fatalf("LogPosition failed: %v", err)
+	}
+	pm.Set("a", 2)
+	pm.Set("b", 3)
+	var keys []string
+	follow := func(op, fullKey, rawValue string) bool {
+		keys = append(keys, fullKey+"="+rawValue)
+		return true
+	}
+	if err := store.ReadLogSince(epoch, offset, follow); err != nil {
+		t.Fatalf("ReadLogSince failed: %v", err)
+	}
+	if strings.Join(keys, ",") != "m:a=2,m:b=3" {
+		t.Fatalf("unexpected records: %v", keys)
+	}
+
+	epoch, offset, _ = store.LogPosition()
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("shrink failed: %v", err)
+	}
+	pm.Set("c", 4)
+	keys = nil
+	if err := store.ReadLogSince(epoch, offset, follow); !errors.Is(err, ErrLogCompacted) {
+		t.Fatalf("expected ErrLogCompacted, got: %v", err)
+	}
+	if keys != nil {
+		t.Fatalf("expected no records after compaction, got: %v", keys)
+	}
+
+	// Resync from a new position
+	newEpoch, offset, _ := store.LogPosition()
+	if newEpoch != epoch+1 {
+		t.Fatalf("expected epoch %d, got %d", epoch+1, newEpoch)
+	}
+	pm.Set("d", 5)
+	if err := store.ReadLogSince(newEpoch, offset, follow); err != nil {
+		t.Fatalf("ReadLogSince failed: %v", err)
+	}
+	if strings.Join(keys, ",") != "m:d=5" {
+		t.Fatalf("unexpected records: %v", keys)
+	}
+}
+
+// TestStore_WriteMarker tests that markers are visited by ReadLog, don't affect keys,
+// and are dropped or kept by Shrink.
+func TestStore_WriteMarker(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		var opts []Option
+		if keep {
+			opts = append(opts, WithKeepMarkers())
+		}
+		f := NewMemFile(nil)
+		store := New(opts...)
+		pm, _ := Map[int](store, "")
+		if err := store.OpenFile(f); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		pm.Set("a", 1)
+		if err := store.WriteMarker("checkpoint", []byte(`{"n":1}`)); err != nil {
+			t.Fatalf("WriteMarker failed: %v", err)
+		}
+		if err := store.WriteMarker("bad", []byte("a\nb")); err == nil {
+			t.Fatal("expected an error for data with a newline")
+		}
+		pm.Set("b", 2)
+		store.Close()
+
+		markers := func(store *Store) []string {
+			var got []string
+			store.ReadLog(0, func(op, fullKey, rawValue string) bool {
+				if op == "M" {
+					got = append(got, fullKey+"="+rawValue)
+				}
+				return true
+			})
+			return got
+		}
+
+		store = New(opts...)
+		pm, _ = Map[int](store, "")
+		if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+			t.Fatalf("failed to reopen store: %v", err)
+		}
+		if got := markers(store); len(got) != 1 || got[0] != `checkpoint={"n":1}` {
+			t.Fatalf("unexpected markers: %v", got)
+		}
+		if pm.Size() != 2 || store.OrphanCount() != 0 {
+			t.Fatalf("markers must not create keys: %d keys, %d orphans", pm.Size(), store.OrphanCount())
+		}
+		store.WriteMarker("schema", []byte("v2"))
+		for range 2 {
+			if err := store.Shrink(); err != nil {
+				t.Fatalf("shrink failed: %v", err)
+			}
+		}
+		got := markers(store)
+		if keep && strings.Join(got, ",") != `checkpoint={"n":1},schema=v2` {
+			t.Errorf("expected markers to be kept in order, got: %v", got)
+		}
+		if !keep && got != nil {
+			t.Errorf("expected markers to be dropped, got: %v", got)
+		}
+		if _, walRecords := store.Stats(); walRecords != int32(2+len(got)) {
+			t.Errorf("expected %d WAL records, got %d", 2+len(got), walRecords)
+		}
+		store.Close()
+	}
+}
+
+// TestStore_SyncDisabled tests that a zero sync interval leaves all I/O to explicit calls.
+func TestStore_SyncDisabled(t *testing.T) {
+	if d := syncBackoff(0, 0); d != syncDisabled {
+		t.Fatalf("expected disabled sync, got %v", d)
+	}
+	f := &syncCountingFile{MemFile: NewMemFile([]byte(WalHeader + "\n"))}
+	store := New(WithSyncInterval(0))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	pm.SetAsync("key", 1)
+
+	time.Sleep(50 * time.Millisecond)
+	if f.syncs != 0 || strings.Contains(string(f.Bytes()), "m:key") {
+		t.Fatalf("expected no background I/O, got %d syncs, WAL %q", f.syncs, f.Bytes())
+	}
+	if err := store.FSyncAll(); err != nil {
+		t.Fatalf("FSyncAll failed: %v", err)
+	}
+	if f.syncs != 1 || !strings.Contains(string(f.Bytes()), "S m:key\n1\n") {
+		t.Fatalf("expected FSyncAll to write and sync, got %d syncs, WAL %q", f.syncs, f.Bytes())
+	}
+}
+
+// TestStore_UnknownOpPolicy tests that records with an unknown operation are skipped
+// or fail Open.
+func TestStore_UnknownOpPolicy(t *testing.T) {
+	wal := WalHeader + "\nS m:a\n1\nX m:a\n2\nX other\n3\nS m:b\n4\n"
+
+	var logs bytes.Buffer
+	store := New(WithLogger(log.New(&logs, "", 0)))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(NewMemFile([]byte(wal))); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if got := mapContents(pm); !maps.Equal(got, map[string]int{"a": 1, "b": 4}) {
+		t.Errorf("unexpected contents: %v", got)
+	}
+	if store.OrphanCount() != 0 {
+		t.Errorf("expected the unknown record not to become an orphan, got %d", store.OrphanCount())
+	}
+	if !strings.Contains(logs.String(), "unknown operation") {
+		t.Errorf("expected a log message, got %q", logs.String())
+	}
+	var ops []string
+	store.ReadLog(0, func(op, fullKey, rawValue string) bool {
+		ops = append(ops, op)
+		return true
+	})
+	if strings.Join(ops, "") != "SXXS" {
+		t.Errorf("expected ReadLog to visit unknown records, got %v", ops)
+	}
+	store.Close()
+
+	store = New(WithUnknownOpPolicy(UnknownOpError))
+	Map[int](store, "m")
+	f := NewMemFile([]byte(wal))
+	if err := store.OpenFile(f); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("expected ErrUnknownOp, got: %v", err)
+	}
+	if string(f.Bytes()) != wal {
+		t.Fatalf("expected the file to stay untouched, got %q", f.Bytes())
+	}
+}
+
+// TestStore_UseAfterClose tests that methods called after Close return ErrStoreClosed
+// instead of panicking, and that in-memory data stays readable.
+func TestStore_UseAfterClose(t *testing.T) {
+	store := New(WithLogger(log.New(io.Discard, "", 0)))
+	pm, _ := Map[int](store, "m")
+	f := NewMemFile(nil)
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	pm.Set("a", 1)
+	store.Set("orphan", 1)
+	var handled []error
+	store.ErrorHandler = func(err error) { handled = append(handled, err) }
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	wal := string(f.Bytes())
+
+	noopLog := func(string, string, string) bool { return true }
+	calls := map[string]func() error{
+		"Close":           store.Close,
+		"Load":            store.Load,
+		"Set":             func() error { return store.Set("x", 1) },
+		"Delete":          func() error { return store.Delete("orphan") },
+		"Get":             func() error { _, err := Get[int](store, "orphan"); return err },
+		"FSyncAll":        store.FSyncAll,
+		"Quiesce":         store.Quiesce,
+		"Shrink":          store.Shrink,
+		"Compact":         store.Compact,
+		"Ping":            store.Ping,
+		"WriteMarker":     func() error { return store.WriteMarker("x", nil) },
+		"ReadLog":         func() error { return store.ReadLog(0, noopLog) },
+		"ReadLogSince":    func() error { return store.ReadLogSince(0, 0, noopLog) },
+		"LogPosition":     func() error { _, _, err := store.LogPosition(); return err },
+		"WALSize":         func() error { _, err := store.WALSize(); return err },
+		"ShrinkEstimate":  func() error { _, _, _, err := store.ShrinkEstimate(); return err },
+		"RangeOrphans":    func() error { return store.RangeOrphans(func(string, string) bool { return true }) },
+		"DumpJSON":        func() error { return store.DumpJSON(io.Discard) },
+		"LoadJSON":        func() error { return store.LoadJSON(strings.NewReader(`{"x":1}`)) },
+		"StartAutoShrink": func() error { return store.StartAutoShrink(time.Second, 2) },
+		"Map":             func() error { _, err := Map[int](store, "n"); return err },
+		"SetFSync":        func() error { return pm.SetFSync("a", 2) },
+		"DeleteFSync":     func() error { return pm.DeleteFSync("a") },
+		"UpdateFSync": func() error {
+			_, _, err := pm.UpdateFSync("a", func(upd *Update[int]) { upd.Value++ })
+			return err
+		},
+		"LoadFrom": func() error {
+			_, err := pm.LoadFrom(maps.All(map[string]int{"b": 1}))
+			return err
+		},
+		"RangeUpdate": func() error {
+			_, err := pm.RangeUpdate(func(string, *Update[int]) {})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, ErrStoreClosed) {
+			t.Errorf("%s: expected ErrStoreClosed, got: %v", name, err)
+		}
+	}
+
+	// Immediate map writes report the error, but change memory like a failed write does
+	pm.Set("a", 3)
+	pm.Delete("a")
+	pm.Update("c", func(upd *Update[int]) { upd.Value = 1 })
+	if len(handled) != 3 {
+		t.Errorf("expected 3 errors reported to ErrorHandler, got: %v", handled)
+	}
+	for _, err := range handled {
+		if !errors.Is(err, ErrStoreClosed) {
+			t.Errorf("expected ErrStoreClosed reported, got: %v", err)
+		}
+	}
+	pm.SetAsync("d", 1)
+	pm.Sync()
+
+	// Methods without an error result don't panic
+	store.Stats()
+	store.WriteAmplification()
+	store.PendingCount()
+	if store.OrphanCount() != 0 || store.MapNames() != nil || store.Maps() != nil {
+		t.Errorf("expected no orphans and maps of a closed store")
+	}
+	if v, ok := pm.Get("d"); !ok || v != 1 {
+		t.Errorf("expected in-memory data to stay readable, got %d, %v", v, ok)
+	}
+	if string(f.Bytes()) != wal {
+		t.Errorf("expected no writes after Close, got %q", f.Bytes())
+	}
+}
+
+// TestStore_OpenAt tests a WAL embedded in a larger file after an application header,
+// which must survive writes and Shrink.
+func TestStore_OpenAt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.bin")
+	appHeader := []byte("APP-HEADER-v1\n\x00\x00")
+	if err := os.WriteFile(path, appHeader, 0644); err != nil {
+		t.Fatal(err)
+	}
+	open := func() (*Store, *PersistMap[int]) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := New()
+		pm, _ := Map[int](store, "m")
+		if err := store.OpenAt(f, int64(len(appHeader))); err != nil {
+			t.Fatalf("OpenAt failed: %v", err)
+		}
+		return store, pm
+	}
+
+	store, pm := open()
+	for i := range 10 {
+		pm.Set("a", i)
+	}
+	pm.Set("b", 1)
+	_, before, _ := store.LogPosition()
+	r, _ := store.f.NewReader()
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, errSectionRewritten) {
+		t.Errorf("expected a reader from before Shrink to fail, got: %v", err)
+	}
+	_, after, _ := store.LogPosition()
+	if after >= before {
+		t.Errorf("expected Shrink to reduce the WAL, %d -> %d bytes", before, after)
+	}
+	pm.Set("c", 2)
+	store.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, appHeader) || !bytes.HasPrefix(data[len(appHeader):], []byte(WalHeader)) {
+		t.Fatalf("expected the WAL after the application header, got %q", data)
+	}
+	if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) != 0 {
+		t.Errorf("expected temporary files to be removed, got %v", matches)
+	}
+
+	store, pm = open()
+	defer store.Close()
+	if got := mapContents(pm); !maps.Equal(got, map[string]int{"a": 9, "b": 1, "c": 2}) {
+		t.Errorf("unexpected contents after reopen: %v", got)
+	}
+
+	short, _ := os.OpenFile(path, os.O_RDWR, 0)
+	if err := New().OpenAt(short, int64(len(data))+1); err == nil {
+		t.Error("expected an error for an offset past the end of file")
+	}
+}
+
+// TestStore_Latency tests that durations of writes and fsyncs are tracked, and that
+// the recent average reacts to a slow disk.
+func TestStore_Latency(t *testing.T) {
+	f := newFaultyFile([]byte(WalHeader + "\n"))
+	store := New(WithSyncInterval(0))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	for i := range 20 {
+		pm.Set("a", i)
+	}
+	pm.SetFSync("a", 0)
+	write, sync := store.Latency()
+	if write.Count != 21 || sync.Count != 1 {
+		t.Fatalf("expected 21 writes and 1 fsync, got %d and %d", write.Count, sync.Count)
+	}
+	if write.Max < write.Mean || write.Mean <= 0 {
+		t.Errorf("unexpected write stats: %+v", write)
+	}
+
+	f.syncDelay.Store(int64(10 * time.Millisecond))
+	for range 5 {
+		pm.SetFSync("a", 1)
+	}
+	_, slow := store.Latency()
+	if slow.Count != 6 || slow.Max < 10*time.Millisecond {
+		t.Fatalf("expected slow fsyncs to be tracked, got %+v", slow)
+	}
+	if slow.Recent <= sync.Recent || slow.Mean <= sync.Mean {
+		t.Errorf("expected averages to rise with slow fsyncs, got %+v before, %+v after", sync, slow)
+	}
+}
+
+// TestStore_LoadError tests that damaged records fail Open with a *LoadError
+// pointing at the record.
+func TestStore_LoadError(t *testing.T) {
+	head := WalHeader + "\n"
+	good := "S m:a\n1\nS m:b\n2\n"
+	tests := []struct {
+		name    string
+		damaged string
+		op, key string
+		cause   error
+	}{
+		{"damaged header", "garbage\n1\n", "", "", errInvalidRecord},
+		{"invalid value", "S m:c\n{bad\n", "S", "m:c", nil},
+		{"unknown op", "X m:c\n1\n", "X", "m:c", ErrUnknownOp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := New(WithUnknownOpPolicy(UnknownOpError))
+			Map[int](store, "m")
+			err := store.OpenFile(NewMemFile([]byte(head + good + tt.damaged + good)))
+			var loadErr *LoadError
+			if !errors.As(err, &loadErr) {
+				t.Fatalf("expected a LoadError, got: %v", err)
+			}
+			if loadErr.Offset != int64(len(head+good)) || loadErr.Record != 3 {
+				t.Errorf("expected record 3 at offset %d, got record %d at %d", len(head+good), loadErr.Record, loadErr.Offset)
+			}
+			if loadErr.Op != tt.op || loadErr.Key != tt.key {
+				t.Errorf("expected op %q and key %q, got %q and %q", tt.op, tt.key, loadErr.Op, loadErr.Key)
+			}
+			if tt.cause != nil && !errors.Is(err, tt.cause) {
+				t.Errorf("expected the cause %v, got: %v", tt.cause, err)
+			}
+		})
+	}
+}
+
+// TestStore_ShrinkRate tests that WithShrinkRate throttles Shrink, and that Close
+// cancels a throttled Shrink without losing data.
+func TestStore_ShrinkRate(t *testing.T) {
+	value := strings.Repeat("x", 1000)
+	fill := func(pm *PersistMap[string]) {
+		for i := range 3000 {
+			pm.Set(strconv.Itoa(i), value)
+		}
+	}
+
+	store := New(WithShrinkRate(20 << 20))
+	pm, _ := Map[string](store, "m")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	fill(pm)
+	start := time.Now()
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	// About 3MB at 20MB/s, the sleep follows each full megabyte
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("expected Shrink to be throttled, took %v", took)
+	}
+	store.Close()
+
+	f := NewMemFile(nil)
+	store = New(WithShrinkRate(1 << 20))
+	pm, _ = Map[string](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	fill(pm)
+	shrinkErr := make(chan error)
+	go func() { shrinkErr <- store.Shrink() }()
+	time.Sleep(50 * time.Millisecond)
+	start = time.Now()
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("expected Close to cancel the Shrink, took %v", took)
+	}
+	if err := <-shrinkErr; !errors.Is(err, ErrShrinkCanceled) {
+		t.Fatalf("expected ErrShrinkCanceled, got: %v", err)
+	}
+
+	store = New()
+	pm, _ = Map[string](store, "m")
+	if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if pm.Size() != 3000 {
+		t.Fatalf("expected 3000 keys after a canceled Shrink, got %d", pm.Size())
+	}
+}
+
+// TestStore_CompactKeys tests the compact keys format: namespaces are written as IDs,
+// translated back on load, by ReadLog and after Shrink.
+func TestStore_CompactKeys(t *testing.T) {
+	f := NewMemFile(nil)
+	open := func(f *MemFile, opts ...Option) (*Store, *PersistMap[int], *PersistMap[int]) {
+		store := New(opts...)
+		long, _ := Map[int](store, "a_rather_long_map_name")
+		other, _ := Map[int](store, "m")
+		if err := store.OpenFile(f); err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		return store, long, other
+	}
+
+	store := New(WithCompactKeys(), WithChecksums())
+	long, _ := Map[int](store, "a_rather_long_map_name")
+	other, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	for i := range 5 {
+		long.Set(strconv.Itoa(i), i)
+	}
+	other.Set("x", 1)
+	store.Set("orphans:y", 2)
+	store.Set("plain", 3)
+	other.Delete("x")
+	wal := string(f.Bytes())
+	if !strings.HasPrefix(wal, WalHeaderChecksums+" ns\n") {
+		t.Fatalf("unexpected header: %q", wal)
+	}
+	if strings.Contains(wal, "a_rather_long_map_name:") || strings.Count(wal, "a_rather_long_map_name") != 1 {
+		t.Fatalf("expected the map name to be written once, got %q", wal)
+	}
+	var keys []string
+	store.ReadLog(0, func(op, fullKey, rawValue string) bool {
+		keys = append(keys, op+" "+fullKey)
+		return true
+	})
+	want := "S a_rather_long_map_name:0,S a_rather_long_map_name:1,S a_rather_long_map_name:2,S a_rather_long_map_name:3," +
+		"S a_rather_long_map_name:4,S m:x,S orphans:y,S plain,D m:x"
+	if strings.Join(keys, ",") != want {
+		t.Errorf("unexpected ReadLog keys: %v", keys)
+	}
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	other.Set("z", 4)
+	store.Set("more:z", 5)
+	store.Close()
+
+	store, long, other = open(f)
+	if long.Size() != 5 || !maps.Equal(mapContents(other), map[string]int{"z": 4}) {
+		t.Errorf("unexpected contents after reopen: %v, %v", mapContents(long), mapContents(other))
+	}
+	for key, want := range map[string]int{"orphans:y": 2, "plain": 3, "more:z": 5} {
+		if v, err := Get[int](store, key); err != nil || v != want {
+			t.Errorf("orphan %s: expected %d, got %d, %v", key, want, v, err)
+		}
+	}
+	other.Set("w", 6)
+	store.Close()
+	if !strings.Contains(string(f.Bytes()), "S 2:w\n6 ") {
+		t.Errorf("expected existing IDs to be reused, got %q", f.Bytes())
+	}
+
+	// An ID used before its definition, as written by a Shrink racing with a new namespace
+	store, _, other = open(NewMemFile([]byte(WalHeader + " ns\nS 1:a\n1\nS 2:b\n2\nN 1\nm\nN 2\no\nN 1\nm\n")))
+	if v, _ := other.Get("a"); v != 1 || store.OrphanCount() != 1 {
+		t.Errorf("expected held back records to load, got %v and %d orphans", mapContents(other), store.OrphanCount())
+	}
+	store.Close()
+
+	// Plain files keep their format
+	plain := NewMemFile([]byte(WalHeader + "\nS m:a\n1\n"))
+	store, _, other = open(plain, WithCompactKeys())
+	other.Set("b", 2)
+	store.Close()
+	if got := string(plain.Bytes()); got != WalHeader+"\nS m:a\n1\nS m:b\n2\n" {
+		t.Errorf("expected a plain file to stay plain, got %q", got)
+	}
+
+	for name, data := range map[string]string{
+		"undefined ID":   WalHeader + " ns\nN 1\nm\nS 2:a\n1\n",
+		"conflicting ID": WalHeader + " ns\nN 1\nm\nN 1\no\n",
+		"unknown flag":   WalHeader + " ns zstd\n",
+	} {
+		store := New()
+		err := store.OpenFile(NewMemFile([]byte(data)))
+		var loadErr *LoadError
+		if err == nil || (name != "unknown flag" && !errors.As(err, &loadErr)) {
+			t.Errorf("%s: expected an error, got: %v", name, err)
+		}
+	}
+}
+
+// TestStore_Reload tests that a reader sees the changes of a writer after Reload,
+// also after the writer replaced the WAL by Shrink
+func TestStore_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reload.wal")
+	writer := New()
+	wm, _ := Map[int](writer, "m")
+	if err := writer.Open(path); err != nil {
+		t.Fatalf("failed to open writer: %v", err)
+	}
+	defer writer.Close()
+	wm.Set("a", 1)
+	wm.Set("b", 2)
+
+	reader := New()
+	rm, _ := Map[int](reader, "m")
+	if err := reader.Open(path); err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	defer reader.Close()
+
+	wm.Set("a", 10)
+	wm.Delete("b")
+	writer.Set("orphan", 3)
+	if v, _ := rm.Get("a"); v != 1 {
+		t.Fatalf("expected the old value before reload, got %d", v)
+	}
+	if err := reader.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if v, _ := rm.Get("a"); v != 10 || rm.Has("b") || reader.OrphanCount() != 1 {
+		t.Errorf("unexpected state after reload: %v, %d orphans", mapContents(rm), reader.OrphanCount())
+	}
+
+	// The writer replaces the file on Shrink
+	if err := writer.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	wm.Set("c", 4)
+	if err := reader.Reload(); err != nil {
+		t.Fatalf("Reload after Shrink failed: %v", err)
+	}
+	if v, _ := rm.Get("c"); v != 4 || rm.Size() != 2 {
+		t.Errorf("unexpected state after reload: %v", mapContents(rm))
+	}
+
+	// A torn record of the writer is skipped, but left in place
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("S m:d\n5")
+	f.Close()
+	if err := reader.Reload(); err != nil || rm.Has("d") {
+		t.Errorf("expected a torn record to be skipped, got %v, %v", err, mapContents(rm))
+	}
+	if data, _ := os.ReadFile(path); !strings.HasSuffix(string(data), "S m:d\n5") {
+		t.Errorf("expected a torn record to be kept, got %q", data)
+	}
+
+	rm.SetAsync("x", 1)
+	if err := reader.Reload(); !errors.Is(err, ErrPendingChanges) {
+		t.Errorf("expected ErrPendingChanges, got %v", err)
+	}
+}
+
+// TestStore_WriteRetry tests that writes failed with transient errors are retried,
+// unlike fsyncs and other errors
+func TestStore_WriteRetry(t *testing.T) {
+	f := newFaultyFile([]byte(WalHeader + "\n"))
+	store := New(WithSyncInterval(0), WithWriteRetry(2, time.Millisecond))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	f.transient.Store(2)
+	if err := pm.SetFSync("a", 1); err != nil {
+		t.Fatalf("expected transient write errors to be retried, got: %v", err)
+	}
+	f.transient.Store(1)
+	if err := store.FSyncAll(); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("expected a failed fsync not to be retried, got: %v", err)
+	}
+	if got := string(f.Bytes()); got != WalHeader+"\nS m:a\n1\n" {
+		t.Errorf("expected partial writes to be cut off, got %q", got)
+	}
+
+	f.transient.Store(3)
+	if err := pm.SetFSync("b", 2); !errors.Is(err, syscall.EAGAIN) {
+		t.Errorf("expected EAGAIN after running out of retries, got: %v", err)
+	}
+	if got := string(f.Bytes()); got != WalHeader+"\nS m:a\n1\n" {
+		t.Errorf("expected a failed write to leave no trace, got %q", got)
+	}
+
+	f.writeLimit.Store(int64(len(f.Bytes())))
+	f.transient.Store(0)
+	if err := pm.SetFSync("c", 3); !errors.Is(err, errInjected) || isTransient(err) {
+		t.Errorf("expected a persistent error, got: %v", err)
+	}
+	if isTransient(syscall.ENOSPC) || isTransient(syscall.EIO) || isTransient(syscall.EINTR) {
+		t.Error("expected ENOSPC, EIO and EINTR not to be retried")
+	}
+}
+
+// TestStore_CompactTo tests writing a compacted copy of the WAL to another path
+func TestStore_CompactTo(t *testing.T) {
+	store, path := createTempStore(t)
+	pm, _ := Map[int](store, "m")
+	for i := range 10 {
+		pm.Set("a", i)
+	}
+	pm.Set("b", 2)
+	pm.Delete("b")
+	pm.SetAsync("c", 3)
+	store.Set("orphan", 4)
+	before, _ := os.ReadFile(path)
+
+	dest := filepath.Join(t.TempDir(), "compacted.wal")
+	if err := store.CompactTo(dest); err != nil {
+		t.Fatalf("CompactTo failed: %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("expected the WAL to stay unchanged")
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("failed to read the copy: %v", err)
+	}
+	if records := strings.Count(string(data), "\n") / 2; records != 3 {
+		t.Errorf("expected 3 records in the copy, got %q", data)
+	}
+
+	copied := New()
+	cm, _ := Map[int](copied, "m")
+	if err := copied.Open(dest); err != nil {
+		t.Fatalf("failed to open the copy: %v", err)
+	}
+	defer copied.Close()
+	if got := mapContents(cm); len(got) != 2 || got["a"] != 9 || got["c"] != 3 {
+		t.Errorf("unexpected contents of the copy: %v", got)
+	}
+	if v, err := Get[int](copied, "orphan"); err != nil || v != 4 {
+		t.Errorf("expected the orphan to be copied, got %d, %v", v, err)
+	}
+
+	// The store keeps working with its WAL
+	pm.Set("d", 5)
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed after CompactTo: %v", err)
+	}
+	if err := store.CompactTo(filepath.Join(t.TempDir(), "missing", "dir.wal")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+
+	// The WAL itself can't be the destination, also via a link
+	link := filepath.Join(t.TempDir(), "link.wal")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	before, _ = os.ReadFile(path)
+	for _, dest := range []string{path, link} {
+		if err := store.CompactTo(dest); !errors.Is(err, ErrDestIsWAL) {
+			t.Errorf("expected ErrDestIsWAL for %s, got %v", dest, err)
+		}
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("expected the WAL to stay unchanged")
+	}
+}
+
+// TestStore_Metadata tests writing metadata into the WAL header, its precedence on
+// reopen and changing it with SetMetadata
+func TestStore_Metadata(t *testing.T) {
+	f := NewMemFile(nil)
+	store := New(WithMetadata(map[string]string{"app": "my app", "schema": "3"}))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	pm.Set("a", 1)
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	store.Close()
+	if got := string(f.Bytes()); !strings.HasPrefix(got, WalHeader+" app=my+app schema=3\n") {
+		t.Fatalf("unexpected header: %q", got)
+	}
+
+	// The header of an existing file takes precedence
+	store = New(WithMetadata(map[string]string{"app": "other"}))
+	pm, _ = Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	if got := store.Metadata(); len(got) != 2 || got["app"] != "my app" || got["schema"] != "3" {
+		t.Errorf("unexpected metadata: %v", got)
+	}
+	if err := store.SetMetadata(map[string]string{"schema": "4=x"}); err != nil {
+		t.Fatalf("SetMetadata failed: %v", err)
+	}
+	if got := store.Metadata(); len(got) != 1 || got["schema"] != "4=x" {
+		t.Errorf("unexpected metadata after SetMetadata: %v", got)
+	}
+	if v, _ := pm.Get("a"); v != 1 {
+		t.Errorf("expected data to survive SetMetadata, got %v", mapContents(pm))
+	}
+	if err := store.SetMetadata(nil); err != nil || store.Metadata() != nil {
+		t.Errorf("expected metadata to be removed, got %v, %v", store.Metadata(), err)
+	}
+	store.Close()
+	if got := string(f.Bytes()); !strings.HasPrefix(got, WalHeader+"\n") {
+		t.Errorf("unexpected header: %q", got)
+	}
+
+	for _, header := range []string{" =x", " a=1 a=2", " a=%zz"} {
+		if err := New().OpenFile(NewMemFile([]byte(WalHeader + header + "\n"))); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%q: expected ErrInvalidHeader, got: %v", header, err)
+		}
+	}
+}
+
+// TestStore_Import tests merging another WAL, with incoming values winning by default
+// or merged by the resolver
+func TestStore_Import(t *testing.T) {
+	// The other replica, in the compact keys format
+	otherPath := filepath.Join(t.TempDir(), "other.wal")
+	other := New(WithCompactKeys())
+	om, _ := Map[int](other, "m")
+	if err := other.Open(otherPath); err != nil {
+		t.Fatalf("failed to open other store: %v", err)
+	}
+	om.Set("a", 10)
+	om.Set("b", 1)
+	om.Set("b", 20)
+	om.Set("gone", 1)
+	om.Delete("gone")
+	other.Set("orphan", 30)
+	other.Close()
+	before, _ := os.ReadFile(otherPath)
+
+	open := func() (*Store, *PersistMap[int]) {
+		store, _ := createTempStore(t)
+		pm, _ := Map[int](store, "m")
+		pm.Set("a", 1)
+		pm.Set("c", 3)
+		store.Set("orphan", 3)
+		return store, pm
+	}
+
+	// Incoming values win by default
+	store, pm := open()
+	if err := store.Import(otherPath, nil); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if got := mapContents(pm); len(got) != 3 || got["a"] != 10 || got["b"] != 20 || got["c"] != 3 {
+		t.Errorf("unexpected contents after import: %v", got)
+	}
+	if v, _ := Get[int](store, "orphan"); v != 30 {
+		t.Errorf("expected the incoming orphan, got %d", v)
+	}
+	store.Close()
+
+	// The resolver merges conflicting keys
+	store, pm = open()
+	var conflicts []string
+	err := store.Import(otherPath, func(key string, existing, incoming []byte) []byte {
+		conflicts = append(conflicts, key)
+		if key == "m:a" {
+			return nil
+		}
+		e, _ := strconv.Atoi(string(existing))
+		i, _ := strconv.Atoi(string(incoming))
+		return []byte(strconv.Itoa(e + i))
+	})
+	if err != nil {
+		t.Fatalf("Import with resolver failed: %v", err)
+	}
+	sort.Strings(conflicts)
+	if !slices.Equal(conflicts, []string{"m:a", "orphan"}) {
+		t.Errorf("unexpected conflicts: %v", conflicts)
+	}
+	if got := mapContents(pm); got["a"] != 1 || got["b"] != 20 {
+		t.Errorf("unexpected contents after merge: %v", got)
+	}
+	if v, _ := Get[int](store, "orphan"); v != 33 {
+		t.Errorf("expected the merged orphan, got %d", v)
+	}
+	if err := store.Import(otherPath, func(string, []byte, []byte) []byte { return []byte("x") }); err == nil {
+		t.Error("expected an error for an undecodable merged value")
+	}
+	store.Close()
+
+	if after, _ := os.ReadFile(otherPath); !bytes.Equal(before, after) {
+		t.Error("expected the imported file to stay unchanged")
+	}
+}
+
+// TestStore_LoadStats tests the statistics of loading the WAL
+func TestStore_LoadStats(t *testing.T) {
+	data := WalHeader + "\nS m:a\n1\nS m:a\n2\nS other:b\n3\nD m:a\n\n"
+	store := New()
+	Map[int](store, "m")
+	if got := store.LoadStats(); got != (LoadStats{}) {
+		t.Errorf("expected zero stats before loading, got %+v", got)
+	}
+	if err := store.OpenFile(NewMemFile([]byte(data))); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	got := store.LoadStats()
+	if got.Records != 4 || got.Bytes != int64(len(data)) || got.Orphans != 1 || got.Duration <= 0 {
+		t.Errorf("unexpected load stats: %+v", got)
+	}
+}
+
+// TestStore_SyncOnWrite tests that WithSyncOnWrite opens the WAL with a sync flag
+// and the store keeps working with it
+func TestStore_SyncOnWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.wal")
+	store := New(WithSyncOnWrite(true))
+	if flags := store.openFlags(); flags&syncWriteFlag != syncWriteFlag {
+		t.Errorf("expected the sync flag in open flags, got %#x", flags)
+	}
+	pm, _ := Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	pm.Set("a", 1)
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	pm.Set("b", 2)
+	store.Close()
+	if data, _ := os.ReadFile(path); string(data) != WalHeader+"\nS m:a\n1\nS m:b\n2\n" {
+		t.Errorf("unexpected WAL: %q", data)
+	}
+}
+
+// TestSyncDir tests that new WAL files and renames by Shrink sync their directory
+func TestSyncDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := syncDir(dir); err != nil {
+		t.Fatalf("syncDir failed: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := syncDir(filepath.Join(dir, "missing")); err == nil {
+			t.Error("Expected an error for a missing directory")
+		}
+	}
+
+	path := filepath.Join(dir, "new.wal")
+	store := New()
+	pm, _ := Map[int](store, "m")
+	if err := store.Open(path); err != nil {
+		t.Fatalf("Failed to open a new WAL: %v", err)
+	}
+	pm.Set("a", 1)
+	pm.Set("a", 2)
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	if err := store.CompactTo(filepath.Join(dir, "copy.wal")); err != nil {
+		t.Fatalf("CompactTo failed: %v", err)
+	}
+	store.Close()
+	if data, _ := os.ReadFile(path); string(data) != WalHeader+"\nS m:a\n2\n" {
+		t.Errorf("Unexpected WAL after shrink: %q", data)
+	}
+}
+
+// TestStore_SyncDirFailure tests that a shrink whose directory sync fails is
+// reported, but still accounted for, as the compacted WAL is in use
+func TestStore_SyncDirFailure(t *testing.T) {
+	for name, opts := range map[string][]Option{"local": nil, "network": {WithNetworkFilesystem()}} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.wal")
+			store := New(opts...)
+			pm, _ := Map[int](store, "m")
+			if err := store.Open(path); err != nil {
+				t.Fatalf("Failed to open store: %v", err)
+			}
+			defer store.Close()
+			for i := range 10 {
+				pm.Set("a", i)
+			}
+			epoch, _, _ := store.LogPosition()
+
+			syncErr := errors.New("dir sync failed")
+			syncDir = func(string) error { return syncErr }
+			defer func() { syncDir = fsyncDir }()
+			if err := store.Shrink(); !errors.Is(err, ErrCommitNotDurable) || !errors.Is(err, syncErr) {
+				t.Fatalf("Expected ErrCommitNotDurable wrapping the sync error, got %v", err)
+			}
+			if err := store.CompactTo(path + ".copy"); !errors.Is(err, ErrCommitNotDurable) {
+				t.Errorf("Expected ErrCommitNotDurable from CompactTo, got %v", err)
+			}
+			syncDir = fsyncDir
+
+			if _, records := store.Stats(); records != 1 {
+				t.Errorf("Expected 1 WAL record after shrink, got %d", records)
+			}
+			if e, _, _ := store.LogPosition(); e != epoch+1 {
+				t.Errorf("Expected the epoch to advance to %d, got %d", epoch+1, e)
+			}
+			if at, _ := store.LastShrink(); at.IsZero() {
+				t.Error("Expected the shrink to be recorded")
+			}
+			pm.Set("b", 1)
+			store.Close()
+			if data, _ := os.ReadFile(path); string(data) != WalHeader+"\nS m:a\n9\nS m:b\n1\n" {
+				t.Errorf("Unexpected WAL after shrink: %q", data)
+			}
+		})
+	}
+}
+
+// TestStore_Maps tests listing the registered maps and reading them without their types
+func TestStore_Maps(t *testing.T) {
+	store := New()
+	users, _ := Map[string](store, "users")
+	counts, _ := Map[int](store, "counts")
+	if err := store.OpenFile(NewMemFile(nil)); err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	users.Set("u1", "Alice")
+	counts.Set("a", 1)
+	counts.SetAsync("b", 2)
+
+	got := map[string]string{}
+	for _, m := range store.Maps() {
+		if m.Name() == "counts" && (m.Size() != 2 || m.PendingCount() != 1) {
+			t.Errorf("unexpected counts: size %d, pending %d", m.Size(), m.PendingCount())
+		}
+		err := m.RangeRaw(func(key, rawValue string) bool {
+			got[m.Name()+"/"+key] = rawValue
+			return true
+		})
+		if err != nil {
+			t.Fatalf("RangeRaw failed: %v", err)
+		}
+	}
+	want := map[string]string{"users/u1": `"Alice"`, "counts/a": "1", "counts/b": "2"}
+	if !maps.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if names := store.Maps(); len(names) != 2 || names[0].Name() != "counts" {
+		t.Fatalf("expected maps sorted by name, got %v", names)
+	}
+}
+
+// TestStore_MapFactory tests a custom ConcurrentMap implementation
+func TestStore_MapFactory(t *testing.T) {
+	// xsync.MapOf with a custom hash function
+	var created atomic.Int32
+	factory := func(sizeHint int) ConcurrentMap {
+		created.Add(1)
+		return xsync.NewMapOfWithHasher[string, interface{}](func(key string, seed uint64) uint64 {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			return h.Sum64() ^ seed
+		}, xsync.WithPresize(sizeHint))
+	}
+	f := NewMemFile(nil)
+	store := New(WithMapFactory(factory), WithSyncInterval(0))
+	pm, _ := Map[int](store, "m")
+	if err := store.OpenFile(f); err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		pm.Set(strconv.Itoa(i), i)
+	}
+	pm.Update("1", func(upd *Update[int]) { upd.Value = 10 })
+	pm.Delete("2")
+	pm.SetAsync("3", 30)
+	pm.DeleteAsync("4")
+	pm.Rename("5", "five")
+	store.Set("orphan:x", "y")
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink failed: %v", err)
+	}
+	if _, ok := pm.values().(*xsync.MapOf[string, interface{}]); !ok {
+		t.Errorf("Expected values in the custom map, got %T", pm.values())
+	}
+	// Orphans, and values and dirty keys of the map
+	if n := created.Load(); n != 3 {
+		t.Errorf("Expected 3 maps to be created, got %d", n)
+	}
+	store.Close()
+
+	store = New(WithMapFactory(factory))
+	pm, _ = Map[int](store, "m")
+	if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	if pm.Size() != 98 {
+		t.Errorf("Expected 98 keys, got %d", pm.Size())
+	}
+	for key, want := range map[string]int{"1": 10, "3": 30, "five": 5, "99": 99} {
+		if v, ok := pm.Get(key); !ok || v != want {
+			t.Errorf("Expected %s=%d, got %d, %v", key, want, v, ok)
+		}
+	}
+	var orphan string
+	store.RangeOrphans(func(key, rawValue string) bool {
+		orphan = key + "=" + rawValue
+		return true
+	})
+	if orphan != `orphan:x="y"` {
+		t.Errorf("Expected the orphan record, got %q", orphan)
+	}
+}
+
+// TestStore_ShrinkNotOpened tests that compaction methods of an unopened store return ErrNotLoaded
+func TestStore_ShrinkNotOpened(t *testing.T) {
+	store := New()
+	if err := store.Shrink(); err != ErrNotLoaded {
+		t.Errorf("Shrink: expected ErrNotLoaded, got %v", err)
+	}
+	if err := store.SetMetadata(map[string]string{"a": "b"}); err != ErrNotLoaded {
+		t.Errorf("SetMetadata: expected ErrNotLoaded, got %v", err)
+	}
+	if err := store.Compact(); err != ErrNotLoaded {
+		t.Errorf("Compact: expected ErrNotLoaded, got %v", err)
+	}
+	if err := store.CompactTo(filepath.Join(t.TempDir(), "copy.wal")); err != ErrNotLoaded {
+		t.Errorf("CompactTo: expected ErrNotLoaded, got %v", err)
+	}
+}
+
+// TestStore_PresizeMaps tests that maps are presized by the number of their records
+// in the WAL, including with compact keys and checksums
+func TestStore_PresizeMaps(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"plain":   nil,
+		"compact": {WithCompactKeys(), WithChecksums()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := NewMemFile(nil)
+			store := New(append(opts, WithSyncInterval(0))...)
+			pm, _ := Map[int](store, "m")
+			if err := store.OpenFile(f); err != nil {
+				t.Fatalf("failed to open store: %v", err)
+			}
+			// Overwrites of few keys, so only presizing makes the map this large
+			for i := 0; i < 20000; i++ {
+				pm.Set(strconv.Itoa(i%10), i)
+			}
+			store.Close()
+
+			store = New(opts...)
+			pm, _ = Map[int](store, "m")
+			if err := store.OpenFile(NewMemFile(f.Bytes())); err != nil {
+				t.Fatalf("failed to reopen store: %v", err)
+			}
+			defer store.Close()
+			if c := pm.values().(*xsync.Map).Stats().Capacity; c < 20000 {
+				t.Errorf("expected capacity of at least 20000, got %d", c)
+			}
+		})
+	}
+}
+
+// BenchmarkStore_OpenPresize measures Open of a map with 1M keys with and without
+// presizing it by a scan of the WAL
+func BenchmarkStore_OpenPresize(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "presize.wal")
+	pm, err := OpenSingleMap[int](path)
+	if err != nil {
+		b.Fatalf("failed to open map: %v", err)
+	}
+	if _, err := pm.LoadFrom(func(yield func(string, int) bool) {
+		for i := 0; i < 1_000_000 && yield("key"+strconv.Itoa(i), i); i++ {
+		}
+	}); err != nil {
+		b.Fatalf("LoadFrom failed: %v", err)
+	}
+	pm.Store.Close()
+
+	for _, presize := range []bool{true, false} {
+		b.Run("presize="+strconv.FormatBool(presize), func(b *testing.B) {
+			presizeOnLoad = presize
+			defer func() { presizeOnLoad = true }()
+			for i := 0; i < b.N; i++ {
+				pm, err := OpenSingleMap[int](path)
+				if err != nil {
+					b.Fatalf("failed to open map: %v", err)
+				}
+				pm.Store.Close()
+			}
+		})
+	}
+}